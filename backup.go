@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Fournisseurs de sauvegarde de base de données.
+// Chaque fournisseur produit un fichier de sauvegarde dans un répertoire
+// donné, fichier qui sera ensuite recopié vers le distant.
+
+const providerSQLAnywhere = "sqlanywhere"
+const providerSQLite = "sqlite"
+const providerPgDump = "pgdump"
+const providerMySQLDump = "mysqldump"
+const providerCommand = "command"
+
+const sqlitecmddefval = "sqlite3"
+const pgdumpcmddefval = "pg_dump"
+const mysqldumpcmddefval = "mysqldump"
+
+type (
+	// backupProvider : produce a backup file of the local database in dir
+	backupProvider interface {
+		Name() string
+		// Tool : executable used for the backup
+		Tool(ctx *contextCache) string
+		// Backup : do the backup and return the produced file
+		Backup(ctx *contextCache, dir string) (string, error)
+	}
+
+	// sqlanywhereProvider : SQL Anywhere dbbackup (historical behaviour)
+	sqlanywhereProvider struct{}
+	// sqliteProvider : SQLite online backup API, through the sqlite3 shell (.backup)
+	sqliteProvider struct{}
+	// pgdumpProvider : PostgreSQL pg_dump (custom format)
+	pgdumpProvider struct{}
+	// mysqldumpProvider : MySQL mysqldump
+	mysqldumpProvider struct{}
+	// commandProvider : run any command, then pick up its output file
+	commandProvider struct{}
+)
+
+// Get backup provider by name
+func newBackupProvider(name string) (backupProvider, error) {
+	switch name {
+	case providerSQLAnywhere:
+		return sqlanywhereProvider{}, nil
+	case providerSQLite:
+		return sqliteProvider{}, nil
+	case providerPgDump:
+		return pgdumpProvider{}, nil
+	case providerMySQLDump:
+		return mysqldumpProvider{}, nil
+	case providerCommand:
+		return commandProvider{}, nil
+	}
+	return nil, fmt.Errorf("Unknown backup provider [%s] (%s|%s|%s|%s|%s)", name,
+		providerSQLAnywhere, providerSQLite, providerPgDump, providerMySQLDump, providerCommand)
+}
+
+// providerDefault : values set by -setdefault for a provider, empty if none
+type providerDefault struct {
+	cmd  string
+	args string
+	base string
+	user string
+}
+
+// -setdefault values per provider: dbbackup arguments belong to SQL Anywhere only
+var providerDefaults = map[string]providerDefault{
+	providerSQLAnywhere: {cmd: backupcmddefval, args: backupargsdefval, base: backupbasedefval, user: backupuserdefval},
+	providerPgDump:      {base: backupbasedefval},
+	providerMySQLDump:   {base: backupbasedefval},
+}
+
+// Split a command line, removing surrounding quotes of each argument
+func splitArgs(args string) []string {
+	var argslist []string
+	for _, argument := range strings.Split(args, " ") {
+		if len(argument) > 0 && argument[0] == '"' {
+			argument = argument[1:]
+		}
+		if len(argument) > 0 && argument[len(argument)-1] == '"' {
+			argument = argument[:len(argument)-1]
+		}
+		argslist = append(argslist, argument)
+	}
+	return argslist
+}
+
+// Tool from -sqlcmd, or provider default
+func toolOrDefault(ctx *contextCache, defval string) string {
+	if *ctx.backupcmd != "" {
+		return *ctx.backupcmd
+	}
+	return defval
+}
+
+// Backup output file: same name as the local database, in dir
+func backupOutput(ctx *contextCache, dir string) string {
+	return filepath.Join(dir, filepath.Base(*ctx.localname))
+}
+
+// Run backup command, logging output on error
+func runBackup(ctx *contextCache, cmd *exec.Cmd, argslog string) error {
+	if *ctx.verbose {
+		mylog.Println(cmd.Path, argslog)
+	}
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if *ctx.verbose {
+			mylog.Errorf("Backup exec error !\n%s", output)
+		}
+	}
+	return err
+}
+
+// Name of provider
+func (sqlanywhereProvider) Name() string { return providerSQLAnywhere }
+
+// Tool of provider
+func (sqlanywhereProvider) Tool(ctx *contextCache) string {
+	return toolOrDefault(ctx, backupcmddefval)
+}
+
+// Backup : dbbackup -y -d -q <dir>. Connection (dbn, uid, pwd) through SQLCONNECT, not args.
+func (p sqlanywhereProvider) Backup(ctx *contextCache, dir string) (string, error) {
+	cmd := exec.CommandContext(ctx.runctx, p.Tool(ctx))
+	cmd.Args = append(cmd.Args, splitArgs(fmt.Sprintf("%s %s", *ctx.backupargs, dir))...)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("SQLCONNECT=dbn=%s;uid=%s;pwd=%s", *ctx.backupbase, *ctx.backupuser, *ctx.backuppwd))
+	if err := runBackup(ctx, cmd, fmt.Sprintf("%s %s", *ctx.backupargs, dir)); err != nil {
+		return "", err
+	}
+	return backupOutput(ctx, dir), nil
+}
+
+// Name of provider
+func (sqliteProvider) Name() string { return providerSQLite }
+
+// Tool of provider
+func (sqliteProvider) Tool(ctx *contextCache) string {
+	return toolOrDefault(ctx, sqlitecmddefval)
+}
+
+// Backup : sqlite3 <db> ".backup '<out>'" (online backup API, database stays usable)
+func (p sqliteProvider) Backup(ctx *contextCache, dir string) (string, error) {
+	out := backupOutput(ctx, dir)
+	dotcmd := fmt.Sprintf(".backup '%s'", strings.Replace(out, "'", "''", -1))
+	cmd := exec.CommandContext(ctx.runctx, p.Tool(ctx), *ctx.localname, dotcmd)
+	if err := runBackup(ctx, cmd, fmt.Sprintf("%s %s", *ctx.localname, dotcmd)); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// Name of provider
+func (pgdumpProvider) Name() string { return providerPgDump }
+
+// Tool of provider
+func (pgdumpProvider) Tool(ctx *contextCache) string {
+	return toolOrDefault(ctx, pgdumpcmddefval)
+}
+
+// Backup : pg_dump -Fc -f <out> [-U <user>] <base>. Password through PGPASSWORD, not args.
+func (p pgdumpProvider) Backup(ctx *contextCache, dir string) (string, error) {
+	out := backupOutput(ctx, dir)
+	cmd := exec.CommandContext(ctx.runctx, p.Tool(ctx), "-Fc", "-f", out)
+	if *ctx.backupuser != "" {
+		cmd.Args = append(cmd.Args, "-U", *ctx.backupuser)
+	}
+	if *ctx.backupargs != "" {
+		cmd.Args = append(cmd.Args, splitArgs(*ctx.backupargs)...)
+	}
+	cmd.Args = append(cmd.Args, *ctx.backupbase)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("PGPASSWORD=%s", *ctx.backuppwd))
+	if err := runBackup(ctx, cmd, strings.Join(cmd.Args[1:], " ")); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// Name of provider
+func (mysqldumpProvider) Name() string { return providerMySQLDump }
+
+// Tool of provider
+func (mysqldumpProvider) Tool(ctx *contextCache) string {
+	return toolOrDefault(ctx, mysqldumpcmddefval)
+}
+
+// Backup : mysqldump --single-transaction --result-file=<out> [-u <user>] <base>. Password through MYSQL_PWD.
+func (p mysqldumpProvider) Backup(ctx *contextCache, dir string) (string, error) {
+	out := backupOutput(ctx, dir)
+	cmd := exec.CommandContext(ctx.runctx, p.Tool(ctx), "--single-transaction", fmt.Sprintf("--result-file=%s", out))
+	if *ctx.backupuser != "" {
+		cmd.Args = append(cmd.Args, "-u", *ctx.backupuser)
+	}
+	if *ctx.backupargs != "" {
+		cmd.Args = append(cmd.Args, splitArgs(*ctx.backupargs)...)
+	}
+	cmd.Args = append(cmd.Args, *ctx.backupbase)
+	cmd.Env = append(os.Environ(), fmt.Sprintf("MYSQL_PWD=%s", *ctx.backuppwd))
+	if err := runBackup(ctx, cmd, strings.Join(cmd.Args[1:], " ")); err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// Name of provider
+func (commandProvider) Name() string { return providerCommand }
+
+// Tool of provider
+func (commandProvider) Tool(ctx *contextCache) string {
+	return *ctx.backupcmd
+}
+
+// Backup : run -sqlcmd with -sqlarg, where {dir}, {out}, {db} and {base} are replaced,
+// then pick up -sqlout (default: local database name in dir)
+func (p commandProvider) Backup(ctx *contextCache, dir string) (string, error) {
+	if p.Tool(ctx) == "" {
+		return "", fmt.Errorf("Backup provider %s needs -sqlcmd", providerCommand)
+	}
+	out := backupOutput(ctx, dir)
+	if *ctx.backupout != "" {
+		out = filepath.Join(dir, *ctx.backupout)
+	}
+	replacer := strings.NewReplacer("{dir}", dir, "{out}", out, "{db}", *ctx.localname, "{base}", *ctx.backupbase)
+	cmd := exec.CommandContext(ctx.runctx, p.Tool(ctx))
+	if *ctx.backupargs != "" {
+		for _, argument := range splitArgs(*ctx.backupargs) {
+			cmd.Args = append(cmd.Args, replacer.Replace(argument))
+		}
+	}
+	if err := runBackup(ctx, cmd, strings.Join(cmd.Args[1:], " ")); err != nil {
+		return "", err
+	}
+	if here, _, err := exists(out); err != nil {
+		return "", err
+	} else if !here {
+		return "", fmt.Errorf("Backup command did not produce %s", out)
+	}
+	return out, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/efarrer/iothrottler"
+)
+
+// Plages horaires de bande passante et throttling adaptatif.
+// Syntaxe de -getrate / -putrate :
+//   64k                                  limite fixe (comportement historique)
+//   08:00-18:00=64k,unlimited            64k en journée, sans limite sinon
+//   08:00-12:00=64k,12:00-14:00=1mb,*=10mb
+
+const unlimitedRate = "unlimited"
+const adaptiveLoop = 5       // seconds between two adaptive measures
+const adaptiveFloor = 16000  // never go below 16kB/s
+const adaptiveRTTFactor = 2  // RTT above baseline * factor means congestion
+const adaptiveLowUse = 0.6   // throughput under 60% of the allowed rate means congestion
+const adaptiveIncrease = 0.1 // additive increase, as a part of the scheduled rate
+
+type (
+	// rateSlot : rate to use between two times of day (minutes since midnight)
+	rateSlot struct {
+		from int
+		to   int
+		rate uint64
+	}
+
+	// rateSchedule : time of day schedule, with a default rate. 0 means unlimited.
+	rateSchedule struct {
+		spec  string
+		slots []rateSlot
+		def   uint64
+	}
+)
+
+// Parse one rate value (humanize bytes or unlimited)
+func parseRate(value string) (uint64, error) {
+	value = strings.TrimSpace(value)
+	if strings.EqualFold(value, unlimitedRate) {
+		return 0, nil
+	}
+	return humanize.ParseBytes(value)
+}
+
+// Parse a time of day (hh:mm) in minutes since midnight
+func parseDayTime(value string) (int, error) {
+	parts := strings.Split(strings.TrimSpace(value), ":")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("Bad time of day [%s] (hh:mm)", value)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil || hours < 0 || hours > 24 {
+		return 0, fmt.Errorf("Bad hour in [%s]", value)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("Bad minutes in [%s]", value)
+	}
+	return hours*60 + minutes, nil
+}
+
+// Parse a rate schedule. Entries without time range (or *=rate) set the default rate.
+func parseRateSchedule(spec string) (*rateSchedule, error) {
+	sched := &rateSchedule{spec: spec}
+	for _, entry := range strings.Split(spec, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		equal := strings.Index(entry, "=")
+		if equal < 0 || strings.TrimSpace(entry[:equal]) == "*" {
+			rate, err := parseRate(entry[equal+1:])
+			if err != nil {
+				return nil, err
+			}
+			sched.def = rate
+			continue
+		}
+		bounds := strings.Split(entry[:equal], "-")
+		if len(bounds) != 2 {
+			return nil, fmt.Errorf("Bad time range [%s] (hh:mm-hh:mm=rate)", entry)
+		}
+		from, err := parseDayTime(bounds[0])
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseDayTime(bounds[1])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := parseRate(entry[equal+1:])
+		if err != nil {
+			return nil, err
+		}
+		sched.slots = append(sched.slots, rateSlot{from: from, to: to, rate: rate})
+	}
+	return sched, nil
+}
+
+// Rate to use at time t. First matching slot wins.
+func (sched *rateSchedule) at(t time.Time) uint64 {
+	minutes := t.Hour()*60 + t.Minute()
+	for _, slot := range sched.slots {
+		if slot.from <= slot.to && minutes >= slot.from && minutes < slot.to {
+			return slot.rate
+		}
+		// plage sur minuit (22:00-06:00)
+		if slot.from > slot.to && (minutes >= slot.from || minutes < slot.to) {
+			return slot.rate
+		}
+	}
+	return sched.def
+}
+
+// Human readable rate
+func rateString(rate uint64) string {
+	if rate == 0 {
+		return unlimitedRate
+	}
+	return humanize.Bytes(rate)
+}
+
+func (sched *rateSchedule) String() string {
+	if len(sched.slots) == 0 {
+		return rateString(sched.def)
+	}
+	return fmt.Sprintf("%s (now %s)", sched.spec, rateString(sched.at(time.Now())))
+}
+
+// Bandwidth value for iothrottler
+func poolBandwidth(rate uint64) iothrottler.Bandwidth {
+	if rate == 0 {
+		return iothrottler.Unlimited
+	}
+	return iothrottler.BytesPerSecond * iothrottler.Bandwidth(rate)
+}
+
+// meteredReader : count bytes read, for throughput measures
+type meteredReader struct {
+	r     io.ReadCloser
+	total *int64
+}
+
+func (m *meteredReader) Read(p []byte) (int, error) {
+	n, err := m.r.Read(p)
+	atomic.AddInt64(m.total, int64(n))
+	return n, err
+}
+
+func (m *meteredReader) Close() error {
+	return m.r.Close()
+}
+
+// Measure round trip time with a TCP connection on the endpoint
+func probeRTT(endpoint string) (time.Duration, error) {
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(endpoint, strconv.Itoa(portCheck)), 5*time.Second)
+	if err != nil {
+		return 0, err
+	}
+	conn.Close()
+	return time.Since(start), nil
+}
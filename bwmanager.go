@@ -0,0 +1,210 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/efarrer/iothrottler"
+)
+
+// Gestionnaire de bande passante commun à tout le process.
+// Un budget par sens (get / put), partagé entre les transferts en cours au
+// prorata de leur priorité. Chaque transfert garde son pool iothrottler, dont la
+// bande passante est recalculée à chaque arrivée / départ d'un transfert.
+
+const prioLow = 1    // empty database push
+const prioNormal = 2 // remote database retrieval
+const prioHigh = 4   // database backup push (end of session)
+
+type (
+	// transfer : one throttled reader in a budget
+	transfer struct {
+		pool     *iothrottler.IOThrottlerPool
+		priority int
+	}
+
+	// bandwidthBudget : bandwidth shared by every transfer of one direction
+	bandwidthBudget struct {
+		mu        sync.Mutex
+		name      string
+		sched     *rateSchedule
+		current   uint64
+		bytes     int64
+		transfers []*transfer
+		done      chan struct{}
+	}
+
+	// bandwidthManager : process-wide budgets
+	bandwidthManager struct {
+		get *bandwidthBudget
+		put *bandwidthBudget
+	}
+)
+
+// bwmanager : Hold get/put budgets for all transfers
+var bwmanager bandwidthManager
+
+// Create a budget following a rate schedule
+func newBandwidthBudget(name string, sched *rateSchedule) *bandwidthBudget {
+	return &bandwidthBudget{
+		name:    name,
+		sched:   sched,
+		current: sched.at(time.Now()),
+	}
+}
+
+// Set up process-wide budgets from get/put schedules
+func initBandwidthManager(get, put *rateSchedule) {
+	bwmanager.get = newBandwidthBudget("get", get)
+	bwmanager.put = newBandwidthBudget("put", put)
+}
+
+// Add a reader to the budget. Returned reader is throttled and metered.
+func (b *bandwidthBudget) join(r io.ReadCloser, priority int) (io.ReadCloser, *transfer, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := &transfer{pool: iothrottler.NewIOThrottlerPool(iothrottler.Unlimited), priority: priority}
+	throttled, err := t.pool.AddReader(r)
+	if err != nil {
+		t.pool.ReleasePool()
+		return nil, nil, err
+	}
+	b.transfers = append(b.transfers, t)
+	if len(b.transfers) == 1 {
+		b.current = b.sched.at(time.Now())
+		b.done = make(chan struct{})
+		go b.loop(b.done)
+	}
+	b.rebalance()
+	return &meteredReader{r: throttled, total: &b.bytes}, t, nil
+}
+
+// Remove a transfer from the budget, giving its share back to the others
+func (b *bandwidthBudget) leave(t *transfer) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for idx, item := range b.transfers {
+		if item != t {
+			continue
+		}
+		b.transfers = append(b.transfers[:idx], b.transfers[idx+1:]...)
+		t.pool.ReleasePool()
+		break
+	}
+	if len(b.transfers) == 0 {
+		if b.done != nil {
+			close(b.done)
+			b.done = nil
+		}
+		return
+	}
+	b.rebalance()
+}
+
+// Split current budget between transfers, by priority. Lock must be held.
+func (b *bandwidthBudget) rebalance() {
+	weights := 0
+	for _, t := range b.transfers {
+		weights += t.priority
+	}
+	for _, t := range b.transfers {
+		if b.current == 0 {
+			t.pool.SetBandwidth(iothrottler.Unlimited)
+			continue
+		}
+		share := b.current * uint64(t.priority) / uint64(weights)
+		if share == 0 {
+			share = 1
+		}
+		t.pool.SetBandwidth(poolBandwidth(share))
+	}
+}
+
+// Current schedule
+func (b *bandwidthBudget) schedule() *rateSchedule {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.sched
+}
+
+// Replace the schedule (configuration reload), applied at once
+func (b *bandwidthBudget) setSchedule(sched *rateSchedule) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.sched = sched
+	b.current = sched.at(time.Now())
+	b.rebalance()
+}
+
+// Change current budget (schedule or adaptive decision)
+func (b *bandwidthBudget) setCurrent(rate uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.current = rate
+	b.rebalance()
+}
+
+// Follow the schedule while transfers are running, and back off if the link is congested (adaptive mode).
+// Multiplicative decrease on congestion, additive increase up to the scheduled rate.
+func (b *bandwidthBudget) loop(done <-chan struct{}) {
+	target := b.schedule().at(time.Now())
+	current := target
+	var baseline time.Duration
+	lastbytes := atomic.LoadInt64(&b.bytes)
+	ticker := time.NewTicker(adaptiveLoop * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		newtarget := b.schedule().at(time.Now())
+		if newtarget != target {
+			if *contexte.verbose {
+				mylog.Printf("Bandwidth schedule (%s): %s -> %s", b.name, rateString(target), rateString(newtarget))
+			}
+			target = newtarget
+			current = target
+			b.setCurrent(current)
+		}
+		if !*contexte.adaptive || target == 0 {
+			continue
+		}
+
+		bytes := atomic.LoadInt64(&b.bytes)
+		throughput := uint64(bytes-lastbytes) / adaptiveLoop
+		lastbytes = bytes
+		congested := float64(throughput) < float64(current)*adaptiveLowUse
+		if *contexte.endpoint != "" {
+			if rtt, err := probeRTT(*contexte.endpoint); err == nil {
+				if baseline == 0 || rtt < baseline {
+					baseline = rtt
+				}
+				congested = congested || rtt > baseline*adaptiveRTTFactor
+			}
+		}
+		next := current
+		if congested {
+			next = current / 2
+			if next < adaptiveFloor {
+				next = adaptiveFloor
+			}
+		} else if current < target {
+			next = current + uint64(float64(target)*adaptiveIncrease)
+			if next > target {
+				next = target
+			}
+		}
+		if next != current {
+			if *contexte.verbose {
+				mylog.Printf("Adaptive bandwidth (%s): %s -> %s (throughput %s/s)", b.name, rateString(current), rateString(next), humanize.Bytes(throughput))
+			}
+			current = next
+			b.setCurrent(current)
+		}
+	}
+}
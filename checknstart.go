@@ -18,36 +18,33 @@
 // locaux et distants.
 // Plus tard on fera évoluer le programme en un utilitaire plus complet/complexe.
 //
-// Command Line sample
-// checknstart.exe -setdefault -user pi -pwd xxxxxx -share wd1to -remotefile autorun.inf
+// Command Line sample (mots de passe : checknstart.exe credential share|sql, ou CHECKNSTART_SHARE_PWD / CHECKNSTART_SQL_PWD)
+// checknstart.exe -setdefault -user pi -share wd1to -remotefile autorun.inf
 //                 -localfile c:\tools\autorun.inf -cmd sublime
 //                 -regkey "HKCU\Volatile Environment\1\test" -delay 10
-// checknstart.exe -setdefault -user pi -pwd xxxxxx -share wd1to -remotefile autorun.inf -localfile c:\tools\autorun.inf -cmd sublime -regkey "HKCU\Volatile Environment\1\test" -delay 10
+// checknstart.exe -setdefault -user pi -share wd1to -remotefile autorun.inf -localfile c:\tools\autorun.inf -cmd sublime -regkey "HKCU\Volatile Environment\1\test" -delay 10
 //
 // checknstart.exe -verbose -localfile c:\tools\dacqtest\DARWINSAV.DB -remotefile c:\tools\dacqtest\DARWINSAV.DB.bak -getrate 64k -putrate 64k -cmd calc.exe -delay 6 -regkey "HKCU\Volatile Environment\1\test" -sqlcmd c:\windows\system32\cmd.exe -sqlarg "copy c:\tools\dacqtest\darwinsav.db"
 // checknstart.exe -verbose -localfile c:\tools\dacqtest\DARWINSAV.DB -remotefile c:\tools\dacqtest\DARWINSAV.DB.bak -getrate 640k -putrate 640k -cmd calc.exe -delay 6 -regkey "HKCU\Volatile Environment\2\test" -sqlcmd c:\windows\system32\cmd.exe -sqlarg "/c copy c:\tools\dacqtest\darwinsav.db"
 // checknstart.exe -verbose -localfile c:\tools\dacqloc\DARWINSAV.DB -remotefile c:\tools\dacqphy\DARWINSAV.DB.bak -getrate 640k -putrate 640k -cmd notepad.exe -delay 6 -regkey "HKCU\Volatile Environment\2\test" -sqlcmd c:\windows\system32\cmd.exe -sqlarg "/c copy c:\tools\dacqloc\darwinsav.db"
 // checknstart.exe -verbose -localfile c:\tools\dacqloc\DARWINSAV.DB -cmd notepad.exe -delay 60 -regkey "HKCU\Volatile Environment\2\test" -sqlcmd c:\windows\system32\cmd.exe -sqlarg "/c copy c:\tools\dacqloc\darwinsav.db"
-// checknstart.exe -verbose -localfile c:\tools\dacqloc\DARWINSAV.DB -cmd notepad.exe -delay 60 -regkey "HKCU\Volatile Environment\1\test" -sqlcmd c:\windows\system32\cmd.exe -sqlarg "/c copy c:\tools\dacqloc\darwinsav.db" -endpoint LFRHQBU400619 -setdefault -user emea\chauffourm -pwd xxxxx
+// checknstart.exe -verbose -localfile c:\tools\dacqloc\DARWINSAV.DB -cmd notepad.exe -delay 60 -regkey "HKCU\Volatile Environment\1\test" -sqlcmd c:\windows\system32\cmd.exe -sqlarg "/c copy c:\tools\dacqloc\darwinsav.db" -endpoint LFRHQBU400619 -setdefault -user emea\chauffourm
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net"
 	"os"
-	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"time"
 
-	"golang.org/x/sys/windows/registry"
-
 	"github.com/dustin/go-humanize"
-	"github.com/efarrer/iothrottler"
 	"github.com/sirupsen/logrus"
 )
 
@@ -63,27 +60,74 @@ type (
 		cmd            *string
 		user           *string
 		pwd            *string
+		backupprovider *string
 		backupcmd      *string
 		backupargs     *string
+		backupout      *string
+		validcmd       *string
+		validarg       *string
+		sizemin        *float64
+		sizemax        *float64
+		provider       backupProvider
 		backupbase     *string
 		backupuser     *string
 		backuppwd      *string
 		waitingfor     *string
+		signalspec     *string
+		match          *string
+		signal         readySignal
 		howlong        *int64
 		tocancel       *bool
 		setdefault     *bool
+		workdir        *string
 		temp           string
 		limitgetstring *string
-		limitget       uint64
+		limitget       *rateSchedule
 		limitputstring *string
-		limitput       uint64
+		limitput       *rateSchedule
+		adaptive       *bool
 		verbose        *bool
+		progress       *string
+		compress       *string
+		restore        *int
 		remoteinfo     os.FileInfo
 		localinfo      os.FileInfo
 		refreshneed    bool
 		starttime      time.Time
 		endtime        time.Time
-		cmdhandle      *exec.Cmd
+		child          *supervisor
+		runctx         context.Context
+		finalbackup    *bool
+		backupdone     bool
+		remotelock     *bool
+		lockstale      *int64
+		locks          []*lockFile
+		logformat      *string
+		loglevel       *string
+		logdir         *string
+		job            *string
+		logfile        *rotatingWriter
+		logkeep        *int
+		logdays        *int
+		logmaxtotal    *string
+		logmaxsize     *string
+		logmaxage      *int64
+		loggzip        *bool
+		logsink        *string
+		history        *string
+		metrics        *string
+		controladdr    *string
+		control        chan controlRequest
+		config         *string
+		cmdline        map[string]bool // options given on the command line
+		dryrun         *bool
+		sinklevel      *string
+		credentials    *string
+		credfile       *string
+		encrypt        *bool
+		minfree        *string
+		snapshot       *bool
+		tag            string
 	}
 )
 
@@ -102,15 +146,15 @@ const localemptynamedefval = "c:\\b3s\\dacq\\base vierge\\darwinsav.db"
 const localnamedefval = "c:\\b3s\\dacq\\base\\darwinsav.db"
 const cmddefval = "c:\\b3s\\dacq\\application\\dacq.exe"
 const userdefval = "DACQ"
-const pwddefval = "dacq"
 const backupcmddefval = "c:\\b3s\\Sybase\\SQL Anywhere 5.0\\win32\\dbbackup.exe"
-const backupargsdefval = "-c \"dbn=%s;uid=%s;pwd=%s\" -y -d -q"
+const backupargsdefval = "-y -d -q"
 const backupbasedefval = "darwinsav"
 const backupuserdefval = "dba"
-const backuppwddefval = "sql"
 const waitingfordefval = "HKLM\\SOFTWARE\\KHEOPS\\KZX\\Initialisation\\DATESAUV"
 const limitgetdefval = "10mb"
 const limitputdefval = "10mb"
+const compressdefval = compressNone
+const progressdefval = progressAuto
 const maxversion = 5
 const spyLoop = 5
 const portCheck = 445
@@ -121,19 +165,18 @@ const logFileName = "checknstart"
 // mdate : Date to set at end (Touch file)
 // src : Source file to copy
 // dst : Destination file
-// bwlimit : Bandwith limit in bytes by second
-func copyFileContents(mdate time.Time, size int64, src, dst string, bwlimit uint64) (int64, error) {
+// budget : Bandwith budget shared with other transfers in the same direction
+// priority : Share of the budget versus other transfers
+func copyFileContents(mdate time.Time, size int64, src, dst string, budget *bandwidthBudget, priority int) (int64, error) {
 	if *contexte.verbose {
 		mylog.Printf("%s -> %s (%s)", src, dst, humanize.Bytes(uint64(size)))
 	}
-	if !*contexte.verbose {
+	if !*contexte.verbose && *contexte.progress == progressNone {
 		fmt.Print(".")
 	}
 
-	pool := iothrottler.NewIOThrottlerPool(iothrottler.BytesPerSecond * iothrottler.Bandwidth(bwlimit))
-	defer pool.ReleasePool()
-
-	file, err := os.Open(src)
+	// sauvegarde temporaire chiffrée (-encrypt) : recopiée en clair
+	file, err := openPlain(src)
 	if err != nil {
 		// fmt.Println("Error:", err) // handle error
 		return 0, err
@@ -144,7 +187,7 @@ func copyFileContents(mdate time.Time, size int64, src, dst string, bwlimit uint
 			if *contexte.verbose {
 				mylog.Print(" KO\n")
 			}
-			if !*contexte.verbose {
+			if !*contexte.verbose && *contexte.progress == progressNone {
 				fmt.Print(".")
 			}
 			return
@@ -152,17 +195,20 @@ func copyFileContents(mdate time.Time, size int64, src, dst string, bwlimit uint
 		if *contexte.verbose {
 			mylog.Print(" OK\n")
 		}
-		if !*contexte.verbose {
+		if !*contexte.verbose && *contexte.progress == progressNone {
 			fmt.Print(".")
 		}
 	}()
 
-	throttledFile, err := pool.AddReader(file)
+	throttledFile, slot, err := budget.join(&contextReader{runctx: contexte.runctx, r: file}, priority)
 	if err != nil {
 		// fmt.Println("Error:", err) // handle error
 		// handle error
 		return 0, err
 	}
+	defer budget.leave(slot)
+	progress := newProgressReader(throttledFile, dst, size)
+	defer func() { progress.finish(err) }()
 
 	out, err := os.Create(dst)
 	if err != nil {
@@ -179,7 +225,7 @@ func copyFileContents(mdate time.Time, size int64, src, dst string, bwlimit uint
 			err = err2
 		}
 	}()
-	bytesw, err := io.Copy(out, throttledFile)
+	bytesw, err := io.Copy(out, progress)
 	if err != nil {
 		return 0, err
 	}
@@ -221,14 +267,14 @@ func getRemotePath(ctx *contextCache) string {
 	return fmt.Sprintf("\\\\%s\\%s\\%s", *ctx.endpoint, *ctx.share, *ctx.remotename)
 }
 
-// Get Path for tempfiles
+// Get Path for tempfiles (workspace of this run)
 func getTempPath(ctx *contextCache) string {
 	return ctx.temp
 }
 
 // Copy one file to another file
 func copyOneFile(ctx *contextCache) (written int64, err error) {
-	return copyFileContents(ctx.remoteinfo.ModTime(), ctx.remoteinfo.Size(), getRemotePath(ctx), *ctx.localname, ctx.limitget)
+	return copyFileContents(ctx.remoteinfo.ModTime(), ctx.remoteinfo.Size(), getRemotePath(ctx), *ctx.localname, bwmanager.get, prioNormal)
 }
 
 // exists returns whether the given file or directory exists or not
@@ -253,37 +299,23 @@ func rename(path string, idx int) error {
 	return os.Rename(path, fmt.Sprintf("%s.%d", path, idx))
 }
 
-// Will rename old localfile to protect it.
-// Will keep MAX_VERSION of the file
-func protectLocalFile(ctx *contextCache) error {
+// Choose the version slot of path: first free slot, or the oldest version (reuse) if
+// MAX_VERSION are used. Read-only. taken: slots considered used now (dry-run planning).
+func pickVersionSlot(path string, verbose bool, taken ...int) (int, bool, error) {
 	var olderdate = time.Now()
 	var idx = -1
-	for index := 0; index <= maxversion; index++ {
-		if *ctx.verbose {
-			log.Printf("step %d/%d for %s", index, maxversion, *ctx.localname)
-		}
-		if index == maxversion {
-			if *ctx.verbose {
-				mylog.Printf("%d versions used. Reusing V%d. Delete file %s.%d", maxversion, idx, *ctx.localname, idx)
-			}
-			if err := os.Chmod(*ctx.localname, 0600); err != nil {
-				return err
-			}
-			if err := delete(*ctx.localname, idx); err != nil {
-				return err
-			}
-			if *ctx.verbose {
-				mylog.Printf("%d versions used. Reusing V%d. Rename file to %s.%d", maxversion, idx, *ctx.localname, idx)
-			}
-			if err := rename(*ctx.localname, idx); err != nil {
-				return err
-			}
-			return nil
+	for index := 0; index < maxversion; index++ {
+		if verbose {
+			mylog.Printf("step %d/%d for %s", index, maxversion, path)
 		}
-
-		filehere, modtime, err := exists(fmt.Sprintf("%s.%d", *ctx.localname, index))
+		filehere, modtime, err := exists(fmt.Sprintf("%s.%d", path, index))
 		if err != nil {
-			return err
+			return -1, false, err
+		}
+		for _, slot := range taken {
+			if slot == index {
+				filehere, modtime = true, time.Now()
+			}
 		}
 		if filehere {
 			if modtime.Before(olderdate) {
@@ -292,176 +324,213 @@ func protectLocalFile(ctx *contextCache) error {
 			}
 			continue
 		}
-		mylog.Printf("%d versions used. Using V%d. Rename file to %s.%d", maxversion, index, *ctx.localname, index)
-		if err := rename(*ctx.localname, index); err != nil {
-			return err
-		}
-		return nil
+		return index, false, nil
 	}
-	return nil
+	return idx, true, nil
 }
 
-// Will rename old localfile to protect it.
-// Will keep MAX_VERSION of the file
-func protectRemoteFile(ctx *contextCache) error {
-	var olderdate = time.Now()
-	var idx = -1
-	for index := 0; index <= maxversion; index++ {
+// Rename path to its version slot, deleting the oldest version if needed
+func protectVersion(ctx *contextCache, path string) (int, error) {
+	idx, reuse, err := pickVersionSlot(path, *ctx.verbose)
+	if err != nil {
+		return -1, err
+	}
+	if reuse {
 		if *ctx.verbose {
-			log.Printf("step %d/%d for %s", index, maxversion, getRemotePath(ctx))
+			mylog.Printf("%d versions used. Reusing V%d. Delete file %s.%d", maxversion, idx, path, idx)
 		}
-		if index == maxversion {
-			if *ctx.verbose {
-				mylog.Printf("%d versions used. Reusing V%d. Delete file %s.%d", maxversion, idx, getRemotePath(ctx), idx)
-			}
-			if err := os.Chmod(getRemotePath(ctx), 0600); err != nil {
-				return err
-			}
-			if err := delete(getRemotePath(ctx), idx); err != nil {
-				return err
-			}
-			if *ctx.verbose {
-				mylog.Printf("%d versions used. Reusing V%d. Rename file to %s.%d", maxversion, idx, getRemotePath(ctx), idx)
-			}
-			if err := rename(getRemotePath(ctx), idx); err != nil {
-				return err
-			}
-			return nil
+		if err := os.Chmod(path, 0600); err != nil {
+			return -1, err
 		}
-
-		filehere, modtime, err := exists(fmt.Sprintf("%s.%d", getRemotePath(ctx), index))
-		if err != nil {
-			return err
+		if err := delete(path, idx); err != nil {
+			return -1, err
 		}
-		if filehere {
-			if modtime.Before(olderdate) {
-				olderdate = modtime
-				idx = index
-			}
-			continue
+		if *ctx.verbose {
+			mylog.Printf("%d versions used. Reusing V%d. Rename file to %s.%d", maxversion, idx, path, idx)
 		}
-		mylog.Printf("%d versions used. Using V%d. Rename file to %s.%d", maxversion, index, getRemotePath(ctx), index)
-		if err := rename(getRemotePath(ctx), index); err != nil {
-			return err
+	} else {
+		mylog.Printf("%d versions used. Using V%d. Rename file to %s.%d", maxversion, idx, path, idx)
+	}
+	if err := rename(path, idx); err != nil {
+		return -1, err
+	}
+	return idx, nil
+}
+
+// Will rename old localfile to protect it.
+// Will keep MAX_VERSION of the file. Returns the version slot used.
+func protectLocalFile(ctx *contextCache) (int, error) {
+	idx, err := protectVersion(ctx, *ctx.localname)
+	if err != nil {
+		return -1, err
+	}
+	version := fmt.Sprintf("%s.%d", *ctx.localname, idx)
+	err = compressVersion(ctx, version)
+	if err == nil {
+		err = encryptVersion(ctx, version)
+	}
+	if err != nil {
+		// la base ne doit jamais rester sous son seul nom de version
+		if rerr := rollbackLocal(ctx, idx); rerr != nil {
+			mylog.WithError(rerr).Errorf("Unable to put back version %d", idx)
 		}
-		return nil
+		return -1, err
 	}
-	return nil
+	return idx, nil
+}
+
+// Will rename old remotefile to protect it.
+// Will keep MAX_VERSION of the file. Returns the version slot used.
+func protectRemoteFile(ctx *contextCache) (int, error) {
+	return protectVersion(ctx, getRemotePath(ctx))
 }
 
 // No more Wildcard and selection in this Array
 // fixedCopy because the Src array is predefined
 func fixedCopy(ctx *contextCache) (int64, error) {
-	if err := protectLocalFile(ctx); err != nil {
-		mylog.Println("fixedCopy error ! Unable to rename localfile (ProtectIt)")
+	if err := checkLocalSpace(ctx); err != nil {
+		mylog.WithError(err).Error("fixedCopy error ! Not enough space for local copy.")
+		return -1, err
+	}
+	slot, err := protectLocalFile(ctx)
+	if err != nil {
+		mylog.WithError(err).Error("fixedCopy error ! Unable to rename localfile (ProtectIt)")
 		return -1, err
 	}
 	ctx.starttime = time.Now()
 	defer func() { ctx.endtime = time.Now() }()
 	bytes, err := copyOneFile(ctx)
 	if err != nil {
+		if rerr := rollbackLocal(ctx, slot); rerr != nil {
+			mylog.WithError(rerr).Errorf("fixedCopy error ! Unable to put back version %d", slot)
+		}
 		return -1, err
 	}
+	if slot >= 0 {
+		history.version(fmt.Sprintf("%s.%d", *ctx.localname, slot))
+	}
 	return bytes, nil
 }
 
-// Use Backupcmd to do database backup
-func dobackup(ctx *contextCache) error {
-	args := *ctx.backupargs
-	argslog := *ctx.backupargs
-	if args == backupargsdefval {
-		args = fmt.Sprintf(backupargsdefval, *ctx.backupbase, *ctx.backupuser, *ctx.backuppwd)
-		argslog = fmt.Sprintf(backupargsdefval, *ctx.backupbase, *ctx.backupuser, "***")
-	}
+// Use backup provider to do database backup. Returns the backup file.
+func dobackup(ctx *contextCache) (string, error) {
 	if *ctx.verbose {
-		mylog.Println(*ctx.backupcmd, argslog, getTempPath(ctx))
-	}
-	cmd := exec.Command(*ctx.backupcmd)
-	// for idx, argument := range cmd.Args {
-	// 	log.Printf("Avant Args - Arg(%d): [%s]", idx, argument)
-	// }
-	argslist := strings.Split(fmt.Sprintf("%s %s", args, getTempPath(ctx)), " ")
-	for _, argument := range argslist {
-		if len(argument) > 0 && argument[0] == '"' {
-			argument = argument[1:]
-		}
-		if len(argument) > 0 && argument[len(argument)-1] == '"' {
-			argument = argument[:len(argument)-1]
-		}
-		cmd.Args = append(cmd.Args, argument)
-	}
-	// for idx, argument := range cmd.Args {
-	// 	log.Printf("Après Args - Arg(%d): [%s]", idx, argument)
-	// }
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		if *ctx.verbose {
-			mylog.Printf("Backup exec error !\n%s", output)
-		}
+		mylog.Printf("Backup with %s provider in %s", ctx.provider.Name(), getTempPath(ctx))
 	}
-	return err
+	return ctx.provider.Backup(ctx, getTempPath(ctx))
 }
 
 // Just after gettng Remote File, we put an empty database file in place of old database file
 func emptyRemoteFile(ctx *contextCache) error {
 	finfo, err := getFileSpec(*ctx.localempty, "empty", *ctx.verbose)
 	if err != nil {
-		mylog.Println("emptyRemoteFile error ! Unable to get empty file info.")
+		mylog.WithError(err).Error("emptyRemoteFile error ! Unable to get empty file info.")
 		return err
 	}
-	if err := protectRemoteFile(ctx); err != nil {
-		mylog.Println("emptyRemoteFile error ! Unable to rename remotefile (ProtectIt)")
+	if err := checkRemoteSpace(ctx, finfo.Size()); err != nil {
+		mylog.WithError(err).Error("emptyRemoteFile error ! Not enough space for remote copy.")
 		return err
 	}
-	written, err := copyFileContents(finfo.ModTime(), finfo.Size(), *ctx.localempty, getRemotePath(ctx), ctx.limitput)
+	slot, err := protectRemoteFile(ctx)
 	if err != nil {
-		mylog.Println("emptyRemoteFile error ! Unable to copy emptyfile to remoteFile.")
+		mylog.WithError(err).Error("emptyRemoteFile error ! Unable to rename remotefile (ProtectIt)")
 		return err
 	}
-	if written != finfo.Size() {
-		mylog.Printf("emptyRemoteFile error ! Bytes written different that Bytes to copy: %d != %d", written, finfo.Size())
+	start := time.Now()
+	written, err := copyFileContents(finfo.ModTime(), finfo.Size(), *ctx.localempty, getRemotePath(ctx), bwmanager.put, prioLow)
+	if err == nil && written != finfo.Size() {
+		err = fmt.Errorf("Bytes written different that Bytes to copy: %d != %d", written, finfo.Size())
+	}
+	if err != nil {
+		mylog.WithError(err).Error("emptyRemoteFile error ! Unable to copy emptyfile to remoteFile.")
+		if rerr := rollbackRemote(ctx, slot); rerr != nil {
+			mylog.WithError(rerr).Errorf("emptyRemoteFile error ! Unable to put back version %d", slot)
+		}
 		return err
 	}
+	history.transfer(false, written, time.Since(start))
+	metrics.transfer("put", written, time.Since(start))
+	if slot >= 0 {
+		history.version(fmt.Sprintf("%s.%d", getRemotePath(ctx), slot))
+	}
 	return nil
 }
 
 // Do backup Cmd and Copy resulting file
 func doBackupNCopy(ctx *contextCache) error {
+	defer setStage(currentStage())
+	setStage(stageBackup)
 	ctx.starttime = time.Now()
-	fileonly := filepath.Base(*ctx.localname)
-	if err := dobackup(ctx); err != nil {
-		mylog.Println("doBackupNCopy error ! Unable to backup file.")
+	if err := checkTempSpace(ctx); err != nil {
+		mylog.WithError(err).Error("doBackupNCopy error ! Not enough space for backup.")
 		return err
 	}
-	finfo, err := getFileSpec(fmt.Sprintf("%s\\%s", getTempPath(ctx), fileonly), "temp", *ctx.verbose)
+	// jamais en même temps que la copie ou la sauvegarde d'une autre instance
+	release, err := lockBackup(ctx)
 	if err != nil {
-		mylog.Println("doBackupNCopy error ! Unable to get file info.")
+		mylog.WithError(err).Error("doBackupNCopy error ! Backup lock not taken.")
 		return err
 	}
-	if err := protectRemoteFile(ctx); err != nil {
-		mylog.Println("doBackupNCopy error ! Unable to rename remotefile (ProtectIt)")
+	defer release()
+	backupstart := time.Now()
+	backupfile, err := dobackup(ctx)
+	if err != nil {
+		mylog.WithError(err).Error("doBackupNCopy error ! Unable to backup file.")
 		return err
 	}
-	written, err := copyFileContents(finfo.ModTime(), finfo.Size(), fmt.Sprintf("%s\\%s", getTempPath(ctx), fileonly), getRemotePath(ctx), ctx.limitput)
+	metrics.backup(time.Since(backupstart))
+	finfo, err := getFileSpec(backupfile, "temp", *ctx.verbose)
 	if err != nil {
-		mylog.Println("doBackupNCopy error ! Unable to copy TempFile to remoteFile.")
+		mylog.WithError(err).Error("doBackupNCopy error ! Unable to get file info.")
+		return err
+	}
+	if err := validateBackup(ctx, backupfile); err != nil {
+		mylog.WithError(err).Error("doBackupNCopy error ! Backup is not valid, remote file is kept.")
 		return err
 	}
-	if written != finfo.Size() {
-		mylog.Printf("doBackupNCopy error ! Bytes written different that Bytes to copy: %d != %d", written, finfo.Size())
+	if err := encryptBackup(ctx, backupfile); err != nil {
+		mylog.WithError(err).Error("doBackupNCopy error ! Unable to encrypt backup.")
+		return err
+	}
+	if err := checkRemoteSpace(ctx, finfo.Size()); err != nil {
+		mylog.WithError(err).Error("doBackupNCopy error ! Not enough space for remote copy.")
+		return err
+	}
+	slot, err := protectRemoteFile(ctx)
+	if err != nil {
+		mylog.WithError(err).Error("doBackupNCopy error ! Unable to rename remotefile (ProtectIt)")
+		return err
+	}
+	copystart := time.Now()
+	written, err := copyFileContents(finfo.ModTime(), finfo.Size(), backupfile, getRemotePath(ctx), bwmanager.put, prioHigh)
+	if err == nil && written != finfo.Size() {
+		err = fmt.Errorf("Bytes written different that Bytes to copy: %d != %d", written, finfo.Size())
+	}
+	if err != nil {
+		mylog.WithError(err).Error("doBackupNCopy error ! Unable to copy TempFile to remoteFile.")
+		if rerr := rollbackRemote(ctx, slot); rerr != nil {
+			mylog.WithError(rerr).Errorf("doBackupNCopy error ! Unable to put back version %d", slot)
+		}
 		return err
 	}
+	ctx.backupdone = true
+	ctx.endtime = time.Now()
+	history.transfer(false, written, ctx.endtime.Sub(copystart))
+	metrics.transfer("put", written, ctx.endtime.Sub(copystart))
+	if slot >= 0 {
+		history.version(fmt.Sprintf("%s.%d", getRemotePath(ctx), slot))
+	}
 	if *contexte.verbose {
-		ctx.endtime = time.Now()
 		elapsedtime := ctx.endtime.Sub(ctx.starttime)
 		seconds := int64(elapsedtime.Seconds())
 		if seconds == 0 {
 			seconds = 1
 		}
 		mylog.WithFields(logrus.Fields{
-			"size":           written,
+			fieldFile:        getRemotePath(ctx),
+			fieldBytes:       written,
+			fieldDuration:    elapsedtime.Seconds(),
 			"sizeHuman":      humanize.Bytes(uint64(written)),
-			"elapsed":        fmt.Sprintf("%v", elapsedtime),
 			"avgBandwithUse": humanize.Bytes(uint64(written / seconds)),
 		}).Info(fmt.Sprintf("between(%v,%v)",
 			contexte.starttime,
@@ -472,15 +541,6 @@ func doBackupNCopy(ctx *contextCache) error {
 	return nil
 }
 
-// Use net use windows command to map drive/UNCressource
-func mapDrive(address string, user string, pw string, verbose bool) ([]byte, error) {
-	exec.Command("c:\\windows\\system32\\net.exe", "use", address, "/delete").Run()
-	if verbose {
-		mylog.Println("net use", address, fmt.Sprintf("/user:%s", user), "*******")
-	}
-	return exec.Command("c:\\windows\\system32\\net.exe", "use", address, fmt.Sprintf("/user:%s", user), pw).CombinedOutput()
-}
-
 // Get file info
 func getFileSpec(src string, lib string, verbose bool) (os.FileInfo, error) {
 	files, err := getFiles(src)
@@ -503,11 +563,8 @@ func getFileSpec(src string, lib string, verbose bool) (os.FileInfo, error) {
 // Check if remote file exist
 func remoteFileHere(ctx *contextCache) error {
 	if *ctx.share != "" || *ctx.endpoint != "" {
-		out, err := mapDrive(fmt.Sprintf("\\\\%s\\%s", *ctx.endpoint, *ctx.share), *ctx.user, *ctx.pwd, *ctx.verbose)
-		if err != nil {
-			if *ctx.verbose {
-				mylog.Println(string(out))
-			}
+		if err := mapDrive(fmt.Sprintf("\\\\%s\\%s", *ctx.endpoint, *ctx.share), *ctx.user, *ctx.pwd, *ctx.verbose); err != nil {
+			mylog.WithError(err).Warn("mapDrive error")
 			return fmt.Errorf("Can't map remote share on \\\\%s\\%s", *ctx.endpoint, *ctx.share)
 		}
 	}
@@ -547,26 +604,73 @@ func setFlagList(ctx *contextCache) {
 	ctx.localempty = flag.String("localempty", "", fmt.Sprintf("Target Filename for empty database file (no wildcard) [%s]", localemptynamedefval))
 	ctx.cmd = flag.String("cmd", "", fmt.Sprintf("Target cmd when ready [%s]", cmddefval))
 	ctx.user = flag.String("user", "", fmt.Sprintf("User account to use share on endpoint [%s]", userdefval))
-	ctx.pwd = flag.String("pwd", "", "Password account to use share on endpoint [***]")
-	ctx.limitgetstring = flag.String("getrate", "", fmt.Sprintf("Download bytes per second limit [%s]", limitgetdefval))
-	ctx.limitputstring = flag.String("putrate", "", fmt.Sprintf("Upload bytes per second limit [%s]", limitputdefval))
+	ctx.pwd = flag.String("pwd", "", fmt.Sprintf("Password account to use share on endpoint, visible in the process list: prefer %s or -credentials", credEnvName(credShare)))
+	ctx.limitgetstring = flag.String("getrate", "", fmt.Sprintf("Download bytes per second limit, or schedule like 08:00-18:00=64k,unlimited [%s]", limitgetdefval))
+	ctx.limitputstring = flag.String("putrate", "", fmt.Sprintf("Upload bytes per second limit, or schedule like 08:00-18:00=64k,unlimited [%s]", limitputdefval))
+	ctx.adaptive = flag.Bool("adaptive", false, "Adaptive throttling: back off when the link is congested (RTT/throughput)")
 	ctx.verbose = flag.Bool("verbose", true, "Verbose mode")
-	// gestion du backup SQL Anywhere
+	ctx.workdir = flag.String("workdir", "", "Base directory for the run workspace (temporary backups) [system temp directory]")
+	ctx.progress = flag.String("progress", progressdefval, "Transfer progress report (auto|bar|log|none), auto: bar on a terminal, and log")
+	ctx.compress = flag.String("compress", compressdefval, "Compression of protected local versions (none|gzip|zstd)")
+	ctx.encrypt = flag.Bool("encrypt", false, fmt.Sprintf("Encrypt protected local versions and temporary backups (AES-256-GCM, key from the %s password)", credBackup))
+	ctx.minfree = flag.String("minfree", minfreedefval, "Free space kept on volumes after a copy or backup (0: none)")
+	ctx.restore = flag.Int("restore", -1, fmt.Sprintf("Restore protected version (0-%d) as localfile then exit", maxversion-1))
+	// gestion du backup SQL Anywhere (et autres fournisseurs)
+	ctx.backupprovider = flag.String("backup", providerSQLAnywhere, fmt.Sprintf("Backup provider (%s|%s|%s|%s|%s)", providerSQLAnywhere, providerSQLite, providerPgDump, providerMySQLDump, providerCommand))
 	ctx.backupcmd = flag.String("sqlcmd", "", fmt.Sprintf("Backup tools full path [%s]", backupcmddefval))
-	ctx.backupargs = flag.String("sqlarg", "", "Backup tools source args [dbbackup default args]")
+	ctx.backupargs = flag.String("sqlarg", "", "Backup tools source args [dbbackup default args] ({dir} {out} {db} {base} with command provider)")
+	ctx.backupout = flag.String("sqlout", "", "Backup output filename picked up with command provider [localfile name]")
+	ctx.validcmd = flag.String("validcmd", "", "Backup validation tool, like dbvalid (exit code 0 if valid) [provider check]")
+	ctx.validarg = flag.String("validarg", "", "Backup validation tool args ({file} is the backup file)")
+	ctx.sizemin = flag.Float64("sizemin", sizemindefval, "Minimum backup size versus previous version (ratio, 0 to disable)")
+	ctx.sizemax = flag.Float64("sizemax", sizemaxdefval, "Maximum backup size versus previous version (ratio, 0 to disable)")
 	ctx.backupbase = flag.String("sqlbase", "", fmt.Sprintf("SQL anywhere database name [%s]", backupbasedefval))
 	ctx.backupuser = flag.String("sqluser", "", fmt.Sprintf("SQL anywhere user account [%s]", backupuserdefval))
-	ctx.backuppwd = flag.String("sqlpwd", "", "SQL anwyhere password account [***]")
-	ctx.waitingfor = flag.String("regkey", "", fmt.Sprintf("Registry item to check [%s]", waitingfordefval))
+	ctx.backuppwd = flag.String("sqlpwd", "", fmt.Sprintf("Database password account, visible in the process list: prefer %s or -credentials", credEnvName(credSQL)))
+	ctx.credentials = flag.String("credentials", credentialsdefval, "Password sources in order, comma separated (env|keyring|file|prompt)")
+	ctx.credfile = flag.String("credfile", "", "Encrypted credential file, for the file source (passphrase from CHECKNSTART_CREDKEY or prompt)")
+	ctx.waitingfor = flag.String("regkey", "", fmt.Sprintf("Registry item to check (HKCU|HKLM|HKU|HKCR) [%s]", waitingfordefval))
+	ctx.signalspec = flag.String("signal", signaldefval, "Ready signal source (registry|file:path|mtime:path|content:path|env:name|http:url|socket:path)")
+	ctx.match = flag.String("match", "", "Signal value rule (date[:layout]|changed|gt:value|eq:value|regex:expr|any) [date:02/01/2006]")
 	ctx.howlong = flag.Int64("delay", 5*60, "Checking delay")
 	ctx.tocancel = flag.Bool("timeoutko", false, "Timeout is it an option? No by default")
+	ctx.remotelock = flag.Bool("remotelock", false, "Lock job on the share too (remote database .lock file)")
+	ctx.lockstale = flag.Int64("lockstale", lockstaledefval, "Seconds without heartbeat before a lock is considered stale")
+	ctx.logformat = flag.String("logformat", logformatdefval, "Log format (text|json|logfmt)")
+	ctx.loglevel = flag.String("loglevel", logleveldefval, "Log level (debug|info|warn|error)")
+	ctx.logdir = flag.String("logdir", "", "Log directory [current directory]")
+	ctx.logkeep = flag.Int("logkeep", logkeepdefval, "Number of log files to keep")
+	ctx.logdays = flag.Int("logdays", logdaysdefval, "Days to keep log files (0: no limit)")
+	ctx.logmaxtotal = flag.String("logmaxtotal", logmaxtotaldefval, "Maximum total size of log files (unlimited: no limit)")
+	ctx.logmaxsize = flag.String("logmaxsize", logmaxsizedefval, "Size of a log file before switching to a new one (unlimited: no limit)")
+	ctx.logmaxage = flag.Int64("logmaxage", logmaxagedefval, "Hours of a log file before switching to a new one (0: no limit)")
+	ctx.loggzip = flag.Bool("loggzip", false, "Gzip old log files")
+	ctx.logsink = flag.String("logsink", "", "Other log destinations, comma separated (syslog://host:port|syslog+tcp://host:port|journald|http(s)://url|eventlog)")
+	ctx.sinklevel = flag.String("sinklevel", sinkleveldefval, "Minimum level sent to -logsink (debug|info|warn|error)")
+	ctx.history = flag.String("history", "", "Run history file (JSON lines) [checknstart-history.jsonl in -logdir]")
+	ctx.metrics = flag.String("metrics", "", "Prometheus metrics listener (host:port, like 127.0.0.1:9464) [none]")
+	ctx.controladdr = flag.String("control", "", "Control API listener (unix:/path, or 127.0.0.1:port with the bearer token of ~/"+controlTokenName+") [none]")
+	ctx.config = flag.String("config", "", "Configuration file, one \"option = value\" per line (command line wins)")
+	ctx.dryrun = flag.Bool("dry-run", false, "Only read-only checks, then print planned actions (renames, copies, deletes)")
+	ctx.job = flag.String("job", dacqname, "Job name, added to every log entry")
+	ctx.snapshot = flag.Bool("snapshot", false, "Only backup the local database to the endpoint, then exit (no copy, no start, no wait). Uses the remote version slots of the sessions")
+	ctx.finalbackup = flag.Bool("finalbackup", false, "On termination signal (Ctrl+C, SIGTERM, logoff), backup database before stopping")
 
 	flag.Parse()
+	// avant -config : flag.Visit verra aussi les options du fichier
+	ctx.cmdline = commandLineFlags()
 }
 
 // Check args and return error if anything is wrong
 func processArgs(ctx *contextCache) (err error) {
 	setFlagList(&contexte)
+	if err := initConfig(ctx); err != nil {
+		return err
+	}
+	if err := initLogging(ctx, ctx.tag); err != nil {
+		return err
+	}
+	mylog.Printf("Starting program ChecknStart %s", VersionNum)
 
 	if isWildcard(*ctx.localname) {
 		return fmt.Errorf("Local name can't include wildcard: %s", *ctx.localname)
@@ -577,9 +681,6 @@ func processArgs(ctx *contextCache) (err error) {
 	}
 
 	if *ctx.setdefault {
-		if *ctx.pwd == "" {
-			*ctx.pwd = pwddefval
-		}
 		if *ctx.user == "" {
 			*ctx.user = userdefval
 		}
@@ -601,26 +702,41 @@ func processArgs(ctx *contextCache) (err error) {
 		if *ctx.cmd == "" {
 			*ctx.cmd = cmddefval
 		}
+		defaults := providerDefaults[*ctx.backupprovider]
 		if *ctx.backupcmd == "" {
-			*ctx.backupcmd = backupcmddefval
+			*ctx.backupcmd = defaults.cmd
 		}
 		if *ctx.backupargs == "" {
-			*ctx.backupargs = backupargsdefval
+			*ctx.backupargs = defaults.args
 		}
 		if *ctx.backupbase == "" {
-			*ctx.backupbase = backupbasedefval
+			*ctx.backupbase = defaults.base
 		}
 		if *ctx.backupuser == "" {
-			*ctx.backupuser = backupuserdefval
-		}
-		if *ctx.backuppwd == "" {
-			*ctx.backuppwd = backuppwddefval
+			*ctx.backupuser = defaults.user
 		}
 		if *ctx.waitingfor == "" {
 			*ctx.waitingfor = waitingfordefval
 		}
 	}
-	ctx.temp = os.Getenv("TEMP")
+	if err := checkCodec(*ctx.compress); err != nil {
+		return err
+	}
+	if _, err := parseRate(*ctx.minfree); err != nil {
+		return fmt.Errorf("Bad free space margin [%s]: %v", *ctx.minfree, err)
+	}
+	if ctx.provider, err = newBackupProvider(*ctx.backupprovider); err != nil {
+		return err
+	}
+	if err := initCredentials(ctx); err != nil {
+		return err
+	}
+	if ctx.signal, err = newReadySignal(*ctx.signalspec, *ctx.waitingfor, *ctx.match); err != nil {
+		return err
+	}
+	if err := initProgress(*ctx.progress, os.Stdout); err != nil {
+		return err
+	}
 	// pour les limites, il n'y a pas de setdefault à positionner
 	if *ctx.limitgetstring == "" {
 		*ctx.limitgetstring = limitgetdefval
@@ -630,106 +746,100 @@ func processArgs(ctx *contextCache) (err error) {
 		*ctx.limitputstring = limitputdefval
 	}
 
-	ctxlimitget, err := humanize.ParseBytes(*ctx.limitgetstring)
+	ctxlimitget, err := parseRateSchedule(*ctx.limitgetstring)
 	if err != nil {
 		return fmt.Errorf("GetLimit value - Error:%s", err) // handle error
 	}
 	// fmt.Printf("with ctxlimitget=%s, ctx.limitget=%d", *ctx.limitgetstring, ctx.limitget)
 	ctx.limitget = ctxlimitget
 
-	ctxlimitput, err := humanize.ParseBytes(*ctx.limitputstring)
+	ctxlimitput, err := parseRateSchedule(*ctx.limitputstring)
 	if err != nil {
 		return fmt.Errorf("PutLimit value - Error:%s", err) // handle error
 	}
 	// fmt.Printf("with ctxlimitput=%s, ctx.limitput=%d", *ctx.limitputstring, ctx.limitput)
 	ctx.limitput = ctxlimitput
+	initBandwidthManager(ctx.limitget, ctx.limitput)
 
 	if *ctx.verbose {
-		fmt.Println("putlimit is", humanize.Bytes(uint64(ctx.limitput)), "by second")
-		fmt.Printf("approx. %sit/s.\n\n", strings.ToLower(humanize.Bytes(uint64(ctx.limitput*9))))
-		fmt.Println("getlimit is", humanize.Bytes(uint64(ctx.limitget)), "by second")
-		fmt.Printf("approx. %sit/s.\n\n", strings.ToLower(humanize.Bytes(uint64(ctx.limitget*9))))
+		fmt.Println("putlimit is", ctx.limitput, "by second")
+		if rate := ctx.limitput.at(time.Now()); rate > 0 {
+			fmt.Printf("approx. %sit/s.\n\n", strings.ToLower(humanize.Bytes(uint64(rate*9))))
+		}
+		fmt.Println("getlimit is", ctx.limitget, "by second")
+		if rate := ctx.limitget.at(time.Now()); rate > 0 {
+			fmt.Printf("approx. %sit/s.\n\n", strings.ToLower(humanize.Bytes(uint64(rate*9))))
+		}
+		if *ctx.adaptive {
+			fmt.Println("adaptive throttling is on")
+		}
 	}
 	return nil
 }
 
-// Check if Registry Key (regkey args) is modified with current date
+// Check if ready signal (registry key by default) is on
 func sqlUpdated(ctx *contextCache) (bool, error) {
-	var regkey registry.Key
-	var err error
-	var keyvalue registry.Key
-	slices := strings.Split(*ctx.waitingfor, "\\")
-	// log.Println("slices:", slices)
-	// log.Println("len slices:", len(slices))
-	if len(slices) > 2 {
-		location := strings.Join(slices[1:len(slices)-1], "\\")
-		// log.Println("location:", location)
-		switch strings.ToUpper(slices[0]) {
-		case "HKCU":
-			regkey = registry.CURRENT_USER
-		case "HKLM":
-			regkey = registry.LOCAL_MACHINE
-		default:
-			return false, fmt.Errorf("Bad Registry Root (HKCU|HKLM) found [%s]", strings.ToUpper(slices[0]))
-		}
-		keyvalue, err = registry.OpenKey(regkey, location, registry.QUERY_VALUE)
-	} else {
-		return false, fmt.Errorf("Bad Registry Path - Need (HKCU|HKLM) then (Root) then (Key) [%s]", *ctx.waitingfor)
-	}
-	if err != nil {
-		return false, nil
-	}
-	defer keyvalue.Close()
-	s, _, err := keyvalue.GetStringValue(slices[len(slices)-1])
-	if err != nil {
-		return false, nil
-	}
-	// log.Println("lu en base de registre:", s)
-	// log.Println("comparaison:", time.Now().Local().Format("02/01/2006"))
-	return s == time.Now().Local().Format("02/01/2006"), nil
+	return ctx.signal.Ready()
 }
 
-// Wait for update and Launch copy if needed
+// Wait for update and Launch copy if needed.
+// Wakes up on signal notification (or poll), external program exit, or timeout.
 func waitandlaunch(ctx *contextCache) error {
-	var remainingsecs = *ctx.howlong
 	firstdone, err := sqlUpdated(ctx)
 	if err != nil {
-		mylog.Println("error in first sqlUpdated?", err)
-		return fmt.Errorf("Unable to get SqlUpdated waitingfor flag [%s]", *ctx.waitingfor)
+		mylog.WithError(err).Error("error in first sqlUpdated?")
+		return fmt.Errorf("Unable to get SqlUpdated waitingfor flag [%s]", ctx.signal)
 	}
 	if firstdone {
-		mylog.Println("Current date is already OK in Registry.")
+		mylog.Printf("Signal %s is already on.", ctx.signal)
 		if *ctx.tocancel {
 			mylog.Println("TimeOut will cancel, so return now.")
 			return nil
 		}
 		mylog.Println("Waiting until timeout.")
 	}
+	deadline := time.Now().Add(time.Duration(*ctx.howlong) * time.Second)
+	runctx, cancel := context.WithDeadline(ctx.runctx, deadline)
+	defer cancel()
+	events := watchSignal(runctx, ctx)
+	loop := pollLoop
+	if events != nil {
+		loop = safetyLoop
+	}
+	poll := time.NewTicker(time.Duration(loop) * time.Second)
+	defer poll.Stop()
 	for {
-		time.Sleep(1 * time.Second)
-		remainingsecs--
+		select {
+		case <-runctx.Done():
+			if ctx.runctx.Err() != nil {
+				return errCanceled
+			}
+			mylog.Printf("No signal from %s. %d second(s) elapsed.", ctx.signal, *ctx.howlong)
+			if !*ctx.tocancel {
+				return doBackupNCopy(ctx)
+			}
+			return nil
+		case <-ctx.child.Done():
+			mylog.Println("External program closed - Stopping loop. No Copy.")
+			return nil
+		case req := <-ctx.control:
+			handleControl(ctx, req)
+			continue
+		case <-events:
+		case <-poll.C:
+		}
+		remainingsecs := int64(time.Until(deadline).Seconds())
 		done, err := sqlUpdated(ctx)
 		if err != nil {
-			mylog.Println("error in sqlUpdated?", err)
-			return fmt.Errorf("Unable to get SqlUpdated waitingfor flag [%s], Remains %d second(s)", *ctx.waitingfor, remainingsecs)
+			mylog.WithError(err).Error("error in sqlUpdated?")
+			return fmt.Errorf("Unable to get SqlUpdated waitingfor flag [%s], Remains %d second(s)", ctx.signal, remainingsecs)
 		}
 		if done && !firstdone {
-			mylog.Println("Current date is OK in Registry")
+			mylog.Printf("Signal %s is on", ctx.signal)
 			return doBackupNCopy(ctx)
 		}
 		if *ctx.verbose {
-			log.Printf("Sleeping 1 second, remaining %d second(s)", remainingsecs)
-		}
-		if remainingsecs <= 0 {
-			mylog.Printf("No update in registry. %d second(s) elapsed.", *ctx.howlong)
-			if !*ctx.tocancel {
-				return doBackupNCopy(ctx)
-			}
-			return nil
-		}
-		if ctx.cmdhandle.ProcessState != nil && ctx.cmdhandle.ProcessState.Exited() {
-			mylog.Println("External program closed - Stopping loop. No Copy.")
-			return nil
+			mylog.Printf("Waiting for %s, remaining %d second(s)", ctx.signal, remainingsecs)
 		}
 	}
 }
@@ -737,18 +847,28 @@ func waitandlaunch(ctx *contextCache) error {
 // Mise en surveillance du process que l'on a démarré + surveillance de la disponibilité SMB (port 445)
 func spyProcess(ctx *contextCache) (bool, error) {
 	if *ctx.verbose {
-		log.Printf("Entering in spymode (loop every %d seconds)", spyLoop)
+		mylog.Printf("Entering in spymode (loop every %d seconds)", spyLoop)
 	}
+	probe := time.NewTicker(spyLoop * time.Second)
+	defer probe.Stop()
 	for {
-		time.Sleep(spyLoop * time.Second)
-		if ctx.cmdhandle.ProcessState != nil && ctx.cmdhandle.ProcessState.Exited() {
+		select {
+		case <-ctx.child.Done():
 			return false, nil
+		case <-ctx.runctx.Done():
+			return false, errCanceled
+		case req := <-ctx.control:
+			handleControl(ctx, req)
+			continue
+		case <-probe.C:
 		}
 
-		conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", *ctx.endpoint, portCheck))
+		address := net.JoinHostPort(*ctx.endpoint, strconv.Itoa(portCheck))
+		conn, err := net.Dial("tcp", address)
+		metrics.probe(err)
 		if err != nil {
 			fmt.Println("Connection error:", err)
-			mylog.Printf("tcp checking (connectivity) on SMB %s:%d - Unreachable", *ctx.endpoint, portCheck)
+			mylog.Printf("tcp checking (connectivity) on SMB %s - Unreachable", address)
 			return true, nil
 		}
 		mylog.Printf("Connection TCP on %s with port %d successful @ip(%s)", *ctx.endpoint, portCheck, conn.RemoteAddr())
@@ -757,46 +877,20 @@ func spyProcess(ctx *contextCache) (bool, error) {
 }
 
 // Démarrage du programme externe que nous allons surveiller
+// Le superviseur ferme Done() à la fin du programme (ou s'il n'a pas pu démarrer)
 func startCmd(ctx *contextCache) (int, error) {
 	// mylog.Printf("Starting [%s]", *ctx.cmd)
-	ctx.cmdhandle = exec.Command(*ctx.cmd)
-
-	if err := ctx.cmdhandle.Start(); err != nil {
-		mylog.Printf("[%s] not started returns: %v", *ctx.cmd, err)
-		return 6, err
-	}
-	mylog.Printf("[%s] started with PID: %d", *ctx.cmd, ctx.cmdhandle.Process.Pid)
+	ctx.child = newSupervisor(*ctx.cmd)
+	metrics.watch(ctx.child)
 
-	if err := ctx.cmdhandle.Wait(); err != nil {
-		mylog.Printf("[%s] Wait returns: %v", *ctx.cmd, err)
+	if err := ctx.child.Start(); err != nil {
+		mylog.WithError(err).Errorf("[%s] not started", *ctx.cmd)
 		return 6, err
 	}
+	mylog.Printf("[%s] started with PID: %d", *ctx.cmd, ctx.child.PID())
 	return 0, nil
 }
 
-// On va faire du ménage dans les logs détaillés
-func cleanLogs(ctx *contextCache) {
-	files, err := getFiles(fmt.Sprintf("%s*.log", logFileName))
-	if err != nil {
-		mylog.Println("cleanlogs error ! Unable to get log files info.")
-		return
-	}
-	filesToRemove := len(files) - cleanlog
-	if filesToRemove > 0 && *ctx.verbose {
-		mylog.Printf("Cleaning %d on %d files.", filesToRemove, len(files))
-	}
-	for idx, file := range files {
-		// filesOut = append(filesOut, file)
-		// ctx.estimatesize += uint64(file.Size())
-		if idx < filesToRemove {
-			if *ctx.verbose {
-				mylog.Printf("Cleaning log (%d) %s", idx, file.Name())
-			}
-			os.Remove(file.Name())
-		}
-	}
-}
-
 // On ajoute des information de session dans le log debug
 //
 func dumpDetailSession() {
@@ -824,7 +918,7 @@ func dumpDetailSession() {
 }
 
 // VersionNum : Litteral version
-const VersionNum = "1.4.2"
+const VersionNum = "1.29.0"
 
 // V 1.0 - Initial release - 2017 09 11
 // V 1.1 - Ajout de x Versions du fichier avant écrasement
@@ -833,34 +927,145 @@ const VersionNum = "1.4.2"
 // V 1.4 - Surveillance de la connexion avec le endpoint. Arrêt de process DACQ.exe si perte de connexion
 // V 1.4.1 - Ajout de log détaillé sur les sessions Remote
 // V 1.4.2 - Meilleure gestion des Fatal Error (on doit rester en mode surveillance si le DACQ.exe est lancé)
+// V 1.5.0 - Compression (gzip/zstd) des versions protégées locales, option -restore
+// V 1.6.0 - Plages horaires de bande passante (-getrate/-putrate) et throttling adaptatif (-adaptive)
+// V 1.7.0 - Budget de bande passante commun aux transferts simultanés, avec priorité par transfert
+// V 1.8.0 - Progression des copies (barre, log périodique, ETA) option -progress
+// V 1.9.0 - Fournisseurs de sauvegarde (SQL Anywhere, SQLite, pg_dump, mysqldump, commande) option -backup
+// V 1.10.0 - Validation de la sauvegarde (taille, intégrité) avant d'écraser le fichier distant
+// V 1.11.0 - Répertoire de travail propre à chaque exécution (-workdir), conservé en cas d'échec
+// V 1.12.0 - Sources de signal "prêt" (registre, fichier, variable, HTTP, socket) option -signal. Compilable sous Linux.
+// V 1.13.0 - Règles de comparaison des valeurs (-match), registre DWORD/QWORD/EXPAND_SZ et racines HKU/HKCR
+// V 1.14.0 - Attente sur événements (fsnotify, notification registre, fin de process) au lieu de la scrutation
+// V 1.15.0 - Superviseur du programme externe (plus d'accès concurrent à exec.Cmd)
+// V 1.16.0 - Arrêt propre sur Ctrl+C / SIGTERM / fermeture de session : copies défaites, sauvegarde finale (-finalbackup)
+// V 1.17.0 - Verrou d'instance unique par tâche (local, et distant avec -remotelock)
+// V 1.18.0 - Journalisation unique : -logformat text|json|logfmt, -loglevel, -logdir, champs job/stage/file/bytes/duration
+// V 1.19.0 - Rotation (-logmaxsize, -logmaxage) et rétention (-logkeep, -logdays, -logmaxtotal, -loggzip) des journaux, tag horodaté sur 24h
+// V 1.20.0 - Destinations de journaux -logsink : syslog RFC5424 UDP/TCP, journald, HTTP (tampon, reprises), journal d'événements Windows
+// V 1.21.0 - Historique des exécutions (-history, JSON lines) et commande "checknstart history" (filtres, -summary)
+// V 1.22.0 - Métriques Prometheus sur -metrics (octets, durées de copie et de sauvegarde, sondes, programme externe, étape)
+// V 1.23.0 - API de contrôle locale -control (status, backup, stop, reload) et fichier de configuration -config
+// V 1.24.0 - Mode -dry-run : contrôles en lecture seule et plan des actions (choix des versions commun, pickVersionSlot)
+// V 1.25.0 - Commande "checknstart doctor" : diagnostic de la configuration (réseau, partage, fichiers, espace disque, outils, signal, journaux), -json
+// V 1.26.0 - Mots de passe par -credentials (env, trousseau, fichier chiffré, saisie), plus de valeur par défaut, masqués dans les journaux et hors ligne de commande
+// V 1.27.0 - -encrypt : versions protégées locales et sauvegardes temporaires conservées chiffrées (AES-256-GCM), déchiffrées à la restauration
+// V 1.28.0 - Contrôle de l'espace libre (copie locale, sauvegarde, copie distante) avant d'écrire, marge -minfree
+// V 1.29.0 - Commande "checknstart serve" : tâches planifiées (cron, jitter, exécutions manquées, déclencheurs, systemd), -snapshot
+
+// End of program: clean the workspace (kept on failure) then exit
+func quit(code int) {
+	if code != 0 {
+		// au niveau erreur : remonte jusqu'aux -logsink
+		mylog.WithField("exitcode", code).Error("Run failed")
+	}
+	unlockAll(&contexte)
+	cleanWorkdir(&contexte, code != 0)
+	if err := history.finish(code); err != nil {
+		mylog.WithError(err).Warn("Unable to write run history")
+	}
+	cleanLogs(&contexte)
+	closeLogging(&contexte)
+	os.Exit(code)
+}
 
 func main() {
-	fmt.Printf("checknstart - Check and start - C.m. 2017 - V%s\n", VersionNum)
-	tag := time.Now().Format("20060102-030405")
-	file, err := os.OpenFile(fmt.Sprintf("%s-%s.log", logFileName, tag), os.O_APPEND|os.O_CREATE, 0755) // For read access.
-	if err != nil {
-		log.Fatal(err)
+	// sous-commandes : pas de bannière, la sortie peut être du JSON
+	if len(os.Args) > 1 && os.Args[1] == historyCommand {
+		os.Exit(runHistoryCommand(os.Args[2:]))
 	}
-	defer file.Close()
-	// The API for setting attributes is a little different than the package level
-	// exported logger. See Godoc.
-	mylog.Out = file
-	mylog.Printf("Starting program ChecknStart %s", VersionNum)
+	if len(os.Args) > 1 && os.Args[1] == serveCommand {
+		os.Exit(runServeCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == credCommand {
+		os.Exit(runCredentialCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == doctorCommand {
+		contexte.tag = time.Now().Format("20060102-150405")
+		os.Exit(runDoctorCommand(&contexte, os.Args[2:]))
+	}
+	fmt.Printf("checknstart - Check and start - C.m. 2017 - V%s\n", VersionNum)
+	tag := time.Now().Format("20060102-150405")
+	contexte.tag = tag
 
 	// Récupération des arguments de base (Variable d'environnement ou Argument en ligne de commande)
 	if err := processArgs(&contexte); err != nil {
-		mylog.Println(err)
+		mylog.Error(err)
 		os.Exit(1) // User error (Usage)
 	}
 
+	// plan seul, sans rien modifier
+	if *contexte.dryrun {
+		code := dryRun(&contexte)
+		closeLogging(&contexte)
+		os.Exit(code)
+	}
+
+	startHistory(&contexte)
+	if err := initMetrics(&contexte); err != nil {
+		mylog.Warn(err)
+	}
+	if err := initControl(&contexte); err != nil {
+		mylog.Warn(err)
+	}
+
+	// répertoire de travail de cette exécution
+	if err := createWorkdir(&contexte, tag); err != nil {
+		mylog.Error(err)
+		os.Exit(1)
+	}
+
+	// contexte racine, annulé par Ctrl+C / SIGTERM / fermeture de session
+	runctx, cancel := rootContext()
+	defer cancel()
+	contexte.runctx = runctx
+
+	// une seule instance par tâche
+	if err := lockLocal(&contexte); err != nil {
+		mylog.Error(err)
+		history.fail(err)
+		quit(9) // Locked
+	}
+
 	if *contexte.verbose {
 		dumpDetailSession()
 	}
 
+	// restauration d'une version protégée (éventuellement compressée)
+	if *contexte.restore >= 0 {
+		setStage(stageRestore)
+		if err := restoreVersion(&contexte, *contexte.restore); err != nil {
+			mylog.Error(err)
+			history.fail(err)
+			quit(3) // Copy error
+		}
+		quit(0)
+	}
+
 	// le fichier distant est il accessible
+	setStage(stageCheck)
 	if err := remoteFileHere(&contexte); err != nil {
-		mylog.Println(err)
-		os.Exit(2) // File not found
+		mylog.Error(err)
+		history.fail(err)
+		quit(2) // File not found
+	}
+	if err := lockRemote(&contexte); err != nil {
+		mylog.Error(err)
+		history.fail(err)
+		quit(9) // Locked
+	}
+
+	// sauvegarde seule (tâche planifiée de "checknstart serve")
+	if *contexte.snapshot {
+		if err := doBackupNCopy(&contexte); err != nil {
+			mylog.Error(err)
+			history.fail(err)
+			if isCanceled(&contexte, err) {
+				quit(8) // Canceled
+			}
+			quit(3) // Copy error
+		}
+		quit(0)
 	}
 
 	if *contexte.verbose {
@@ -871,61 +1076,110 @@ func main() {
 	//	A-t-on besoin de récupérer la base de données remote en local
 	docopy, err := compareFileAge(&contexte)
 	if err != nil {
-		mylog.Println(err)
-		os.Exit(2) // File not found
+		mylog.Error(err)
+		history.fail(err)
+		quit(2) // File not found
 	}
 
 	// Si les dates de fichier nous l'impose, nous devrons copier les fichiers
 	if docopy {
+		setStage(stageCopy)
+		release, err := lockBackup(&contexte)
+		if err != nil {
+			mylog.Error(err)
+			history.fail(err)
+			if isCanceled(&contexte, err) {
+				quit(8) // Canceled
+			}
+			quit(9) // Locked
+		}
 		bytes, err := fixedCopy(&contexte)
 		if err != nil {
-			mylog.Println(err)
-			os.Exit(3) // Copy error
+			mylog.Error(err)
+			history.fail(err)
+			if isCanceled(&contexte, err) {
+				quit(8) // Canceled
+			}
+			quit(3) // Copy error
 		}
 		elapsedtime := contexte.endtime.Sub(contexte.starttime)
+		history.transfer(true, bytes, elapsedtime)
+		metrics.transfer("get", bytes, elapsedtime)
 		seconds := int64(elapsedtime.Seconds())
 		if seconds == 0 {
 			seconds = 1
 		}
 		if *contexte.verbose {
 			mylog.WithFields(logrus.Fields{
-				"size":           bytes,
+				fieldFile:        *contexte.localname,
+				fieldBytes:       bytes,
+				fieldDuration:    elapsedtime.Seconds(),
 				"sizeHuman":      humanize.Bytes(uint64(bytes)),
-				"elapsed":        fmt.Sprintf("%v", elapsedtime),
-				"AvgBandwithUse": humanize.Bytes(uint64(bytes / seconds)),
+				"avgBandwithUse": humanize.Bytes(uint64(bytes / seconds)),
 			}).Info(fmt.Sprintf("between(%v,%v)",
 				contexte.starttime,
 				contexte.endtime,
 			))
 		}
 		mylog.Println("copy done.")
-		if err := emptyRemoteFile(&contexte); err != nil {
-			mylog.Printf("Remotefile can't be empty ! error: %s", err)
+		err = emptyRemoteFile(&contexte)
+		release()
+		if err != nil {
+			mylog.WithError(err).Error("Remotefile can't be empty !")
+			history.fail(err)
+			if isCanceled(&contexte, err) {
+				shutdown(&contexte, "copy")
+				quit(8) // Canceled
+			}
 		}
 	} else {
 		mylog.Println("no copy needed.")
 	}
 
-	go startCmd(&contexte)
+	// pas de démarrage après un signal d'arrêt
+	if contexte.runctx.Err() != nil {
+		history.fail(errCanceled)
+		shutdown(&contexte, "check")
+		quit(8) // Canceled
+	}
+	setStage(stageStart)
+	if _, err := startCmd(&contexte); err != nil {
+		history.fail(err)
+	}
 
 	// mylog.Printf("[%s] started", *contexte.cmd)
+	setStage(stageWait)
 	if err := waitandlaunch(&contexte); err != nil {
-		mylog.Printf("WaitAndLaunch error:%v", err)
-		os.Exit(4)
+		mylog.WithError(err).Error("WaitAndLaunch error")
+		history.fail(err)
+		if isCanceled(&contexte, err) {
+			shutdown(&contexte, "wait")
+			quit(8) // Canceled
+		}
+		quit(4)
 	}
 
+	setStage(stageSpy)
 	action, err := spyProcess(&contexte)
 	if err != nil {
-		mylog.Printf("spyProcess returns: %v", err)
-		os.Exit(7)
+		mylog.WithError(err).Error("spyProcess error")
+		history.fail(err)
+		if isCanceled(&contexte, err) {
+			shutdown(&contexte, "spy")
+			quit(8) // Canceled
+		}
+		quit(7)
 	}
 	if action {
-		if err := contexte.cmdhandle.Process.Kill(); err != nil {
-			mylog.Printf("Kill process returns: %v", err)
-			os.Exit(5)
+		stopctx, cancel := context.WithTimeout(context.Background(), stopGrace*time.Second)
+		err := contexte.child.Stop(stopctx)
+		cancel()
+		if err != nil {
+			mylog.WithError(err).Error("Kill process error")
+			history.fail(err)
+			quit(5)
 		}
 		mylog.Println("Has killed process. No connectivity with endpoint")
 	}
-	cleanLogs(&contexte)
-	os.Exit(0)
+	quit(0)
 }
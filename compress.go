@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/klauspost/compress/zstd"
+	"github.com/sirupsen/logrus"
+)
+
+// Compression à la volée des versions protégées.
+// Sur un partage SMB, le fichier distant doit rester une base utilisable par le
+// poste physique : seule une extrémité capable de décompresser (agent distant,
+// versions protégées locales) peut profiter d'un flux compressé. Sans agent
+// distant, les transferts get/put ne sont pas compressés : le taux n'est
+// journalisé que pour les versions protégées.
+
+const compressNone = "none"
+const compressGzip = "gzip"
+const compressZstd = "zstd"
+
+var gzipMagic = []byte{0x1f, 0x8b}
+var zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+
+// readCloserChain : Reader closing every layer (decoder then file)
+type readCloserChain struct {
+	io.Reader
+	closers []func() error
+}
+
+func (r *readCloserChain) Close() error {
+	var err error
+	for _, closer := range r.closers {
+		if cerr := closer(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// countingWriter : count bytes really written on the underlying writer
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// Check if codec is a known one
+func checkCodec(codec string) error {
+	switch codec {
+	case compressNone, compressGzip, compressZstd:
+		return nil
+	}
+	return fmt.Errorf("Unknown compression codec [%s] (none|gzip|zstd)", codec)
+}
+
+// Wrap a writer with the codec compressor
+func newCodecWriter(codec string, w io.Writer) (io.WriteCloser, error) {
+	switch codec {
+	case compressGzip:
+		return gzip.NewWriterLevel(w, gzip.BestSpeed)
+	case compressZstd:
+		return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.SpeedDefault))
+	}
+	return nil, checkCodec(codec)
+}
+
+// Detect codec used for a stream, using its magic number
+func detectCodec(br *bufio.Reader) string {
+	head, _ := br.Peek(len(zstdMagic))
+	if bytes.HasPrefix(head, gzipMagic) {
+		return compressGzip
+	}
+	if bytes.HasPrefix(head, zstdMagic) {
+		return compressZstd
+	}
+	return compressNone
+}
+
+// Open a stored file (protected version), decrypting and decompressing it if needed.
+// Returns the codec, with the encryption suffix if encrypted.
+func openStored(path string) (io.ReadCloser, string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, "", err
+	}
+	br := bufio.NewReader(file)
+	suffix := ""
+	if isEncrypted(br) {
+		dr, err := newDecryptReader(br)
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		br = bufio.NewReader(dr)
+		suffix = "+" + encryptName
+	}
+	codec := detectCodec(br)
+	switch codec {
+	case compressGzip:
+		zr, err := gzip.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		return &readCloserChain{Reader: zr, closers: []func() error{zr.Close, file.Close}}, codec + suffix, nil
+	case compressZstd:
+		zr, err := zstd.NewReader(br)
+		if err != nil {
+			file.Close()
+			return nil, "", err
+		}
+		return &readCloserChain{Reader: zr, closers: []func() error{func() error { zr.Close(); return nil }, file.Close}}, codec + suffix, nil
+	}
+	return &readCloserChain{Reader: br, closers: []func() error{file.Close}}, codec + suffix, nil
+}
+
+// Compress a file in place. Modification time is kept, so version slot selection
+// still works on compressed versions.
+func compressFile(codec string, path string) (raw int64, stored int64, err error) {
+	return rewriteFile(path, codec, func(w io.Writer) (io.WriteCloser, error) {
+		return newCodecWriter(codec, w)
+	})
+}
+
+// Rewrite a file in place through a writer layer (compression, encryption), keeping
+// its modification time. suffix names the temporary file.
+func rewriteFile(path string, suffix string, layer func(io.Writer) (io.WriteCloser, error)) (raw int64, stored int64, err error) {
+	finfo, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer src.Close()
+
+	tmpname := fmt.Sprintf("%s.%s", path, suffix)
+	out, err := os.Create(tmpname)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(tmpname)
+		}
+	}()
+	counter := &countingWriter{w: out}
+	zw, err := layer(counter)
+	if err != nil {
+		return 0, 0, err
+	}
+	if raw, err = io.Copy(zw, src); err != nil {
+		return 0, 0, err
+	}
+	if err = zw.Close(); err != nil {
+		return 0, 0, err
+	}
+	if err = out.Sync(); err != nil {
+		return 0, 0, err
+	}
+	if err = out.Close(); err != nil {
+		return 0, 0, err
+	}
+	src.Close()
+	// version protégée : lisible par son propriétaire seulement
+	if err = os.Chmod(tmpname, 0600); err != nil {
+		return 0, 0, err
+	}
+	if err = os.Rename(tmpname, path); err != nil {
+		return 0, 0, err
+	}
+	if err = os.Chtimes(path, finfo.ModTime(), finfo.ModTime()); err != nil {
+		return 0, 0, err
+	}
+	return raw, counter.n, nil
+}
+
+// Human readable compression ratio (raw / stored)
+func compressRatio(raw, stored int64) string {
+	if stored <= 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.2f", float64(raw)/float64(stored))
+}
+
+// Compress a protected version if compression is wanted
+func compressVersion(ctx *contextCache, path string) error {
+	if *ctx.compress == compressNone {
+		return nil
+	}
+	start := time.Now()
+	raw, stored, err := compressFile(*ctx.compress, path)
+	if err != nil {
+		return fmt.Errorf("Unable to compress version %s: %v", path, err)
+	}
+	if *ctx.verbose {
+		mylog.WithFields(logrus.Fields{
+			fieldFile:     path,
+			fieldBytes:    raw,
+			fieldDuration: time.Since(start).Seconds(),
+			"sizeHuman":   humanize.Bytes(uint64(raw)),
+			"stored":      stored,
+			"storedHuman": humanize.Bytes(uint64(stored)),
+			"ratio":       compressRatio(raw, stored),
+			"compress":    *ctx.compress,
+		}).Info(fmt.Sprintf("protected version %s", path))
+	}
+	return nil
+}
+
+// Restore protected version idx as the local file.
+// The current local file is protected before being replaced.
+func restoreVersion(ctx *contextCache, idx int) error {
+	version := fmt.Sprintf("%s.%d", *ctx.localname, idx)
+	finfo, err := getFileSpec(version, "version", *ctx.verbose)
+	if err != nil {
+		return err
+	}
+	in, codec, err := openStored(version)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	tmpname := fmt.Sprintf("%s.restore", *ctx.localname)
+	out, err := os.Create(tmpname)
+	if err != nil {
+		return err
+	}
+	written, err := io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	if err := os.Chtimes(tmpname, finfo.ModTime(), finfo.ModTime()); err != nil {
+		return err
+	}
+	if here, _, err := exists(*ctx.localname); err != nil {
+		return err
+	} else if here {
+		if _, err := protectLocalFile(ctx); err != nil {
+			os.Remove(tmpname)
+			return err
+		}
+	}
+	if err := os.Rename(tmpname, *ctx.localname); err != nil {
+		return err
+	}
+	mylog.WithFields(logrus.Fields{
+		fieldFile:   *ctx.localname,
+		fieldBytes:  written,
+		"sizeHuman": humanize.Bytes(uint64(written)),
+		"stored":    finfo.Size(),
+		"ratio":     compressRatio(written, finfo.Size()),
+		"compress":  codec,
+	}).Info(fmt.Sprintf("restored %s to %s", version, *ctx.localname))
+	return nil
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Fichier de configuration -config : une option par ligne, "nom = valeur"
+// (nom de l'option sans tiret), lignes vides et commentaires # ignorés.
+// La ligne de commande reste prioritaire. Certaines options peuvent être
+// relues en cours d'exécution (API de contrôle, POST /reload).
+
+// Options taken into account by a reload
+var reloadableFlags = []string{"getrate", "putrate", "loglevel", "sizemin", "sizemax", "validcmd", "validarg", "compress", "finalbackup"}
+
+// configEntry : one option of the configuration file
+type configEntry struct {
+	name  string
+	value string
+	line  int
+}
+
+// Read a configuration file
+func loadConfig(path string) ([]configEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var entries []configEntry
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, "=", 2)
+		name := strings.TrimLeft(strings.TrimSpace(parts[0]), "-")
+		if flag.Lookup(name) == nil {
+			return nil, fmt.Errorf("%s:%d: unknown option [%s]", path, number, name)
+		}
+		value := "true" // option booléenne seule
+		if len(parts) == 2 {
+			value = strings.Trim(strings.TrimSpace(parts[1]), "\"")
+		}
+		entries = append(entries, configEntry{name: name, value: value, line: number})
+	}
+	return entries, scanner.Err()
+}
+
+// Options given on the command line, never overridden by the file.
+// To be read just after flag.Parse: flag.Set marks the file options too.
+func commandLineFlags() map[string]bool {
+	set := make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	return set
+}
+
+// Apply file options not given on the command line (cmdline). only: restrict to these names.
+// Returns names of the options whose value changed.
+func applyConfig(path string, entries []configEntry, only []string, cmdline map[string]bool) ([]string, error) {
+	var changed []string
+	for _, entry := range entries {
+		if cmdline[entry.name] || (only != nil && !contains(only, entry.name)) {
+			continue
+		}
+		previous := flag.Lookup(entry.name).Value.String()
+		if err := flag.Set(entry.name, entry.value); err != nil {
+			return changed, fmt.Errorf("%s:%d: bad value for %s: %v", path, entry.line, entry.name, err)
+		}
+		if flag.Lookup(entry.name).Value.String() != previous {
+			changed = append(changed, entry.name)
+		}
+	}
+	return changed, nil
+}
+
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Load -config at start
+func initConfig(ctx *contextCache) error {
+	if *ctx.config == "" {
+		return nil
+	}
+	entries, err := loadConfig(*ctx.config)
+	if err != nil {
+		return fmt.Errorf("Unable to read configuration: %v", err)
+	}
+	_, err = applyConfig(*ctx.config, entries, nil, ctx.cmdline)
+	return err
+}
+
+// Current values of the named options
+func saveFlags(names []string) map[string]string {
+	saved := make(map[string]string)
+	for _, name := range names {
+		saved[name] = flag.Lookup(name).Value.String()
+	}
+	return saved
+}
+
+// Put back option values saved by saveFlags
+func restoreFlags(saved map[string]string) {
+	for name, value := range saved {
+		flag.Set(name, value)
+	}
+}
+
+// Read -config again, and apply reloadable options. Must run on the main goroutine.
+// A rejected configuration changes nothing.
+func reloadConfig(ctx *contextCache) ([]string, error) {
+	if *ctx.config == "" {
+		return nil, fmt.Errorf("No configuration file (-config)")
+	}
+	entries, err := loadConfig(*ctx.config)
+	if err != nil {
+		return nil, err
+	}
+	saved := saveFlags(reloadableFlags)
+	changed, err := applyConfig(*ctx.config, entries, reloadableFlags, ctx.cmdline)
+	if err == nil {
+		err = checkCodec(*ctx.compress)
+	}
+	level, lerr := logLevel(ctx)
+	if err == nil {
+		err = lerr
+	}
+	get, gerr := parseRateSchedule(*ctx.limitgetstring)
+	if err == nil {
+		err = gerr
+	}
+	put, perr := parseRateSchedule(*ctx.limitputstring)
+	if err == nil {
+		err = perr
+	}
+	if err != nil {
+		// valeurs précédentes remises avant toute utilisation
+		restoreFlags(saved)
+		return nil, err
+	}
+	mylog.SetLevel(level)
+	ctx.limitget, ctx.limitput = get, put
+	bwmanager.get.setSchedule(get)
+	bwmanager.put.setSchedule(put)
+	mylog.Printf("Configuration %s reloaded, changed: %s", *ctx.config, strings.Join(changed, ","))
+	return changed, nil
+}
@@ -0,0 +1,330 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// API de contrôle locale (HTTP/JSON), sur -control 127.0.0.1:port ou unix:/chemin.
+//   GET  /status : étape, programme externe, dernière sonde, dernière copie
+//   POST /backup : sauvegarde et recopie immédiates (attente ou surveillance)
+//   POST /stop   : arrêt du programme externe
+//   POST /reload : relecture de -config
+// Les actions qui touchent à l'état de l'exécution sont faites par la boucle
+// principale (waitandlaunch, spyProcess), jamais par le serveur HTTP.
+// Le socket unix n'est ouvert qu'à son propriétaire (0600). En TCP (postes
+// VDI/RDS partagés), chaque requête doit porter "Authorization: Bearer <jeton>",
+// jeton lu dans ~/.checknstart-control.token (0600), créé au premier besoin.
+
+const controlUnix = "unix:"
+const controlWait = 2 // seconds to wait for the main loop to take a request
+const controlTokenName = ".checknstart-control.token"
+const controlTokenSize = 32 // random bytes of a new token
+
+const actionBackup = "backup"
+const actionReload = "reload"
+
+// errBusy : main loop not in a stage able to run the action
+var errBusy = errors.New("Not available now")
+
+type (
+	// controlRequest : action run by the main loop
+	controlRequest struct {
+		action string
+		reply  chan controlReply
+	}
+
+	// controlReply : result of an action
+	controlReply struct {
+		changed []string
+		err     error
+	}
+
+	// childStatus : external program
+	childStatus struct {
+		Name     string `json:"name"`
+		PID      int    `json:"pid"`
+		State    string `json:"state"`
+		Starts   int    `json:"starts"`
+		ExitCode int    `json:"exitCode"`
+	}
+
+	// controlStatus : GET /status
+	controlStatus struct {
+		Job       string       `json:"job"`
+		Version   string       `json:"version"`
+		PID       int          `json:"pid"`
+		Stage     string       `json:"stage"`
+		Started   time.Time    `json:"started"`
+		Child     *childStatus `json:"child,omitempty"`
+		LastProbe *probeStatus `json:"lastProbe,omitempty"`
+		LastCopy  *copyStatus  `json:"lastCopy,omitempty"`
+	}
+)
+
+// Only loopback addresses, never exposed to the network
+func checkLoopback(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(host, "localhost") {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return fmt.Errorf("Control API must listen on loopback, not [%s]", host)
+}
+
+// Listen on -control: unix socket, or loopback TCP
+func controlListener(address string) (net.Listener, error) {
+	if strings.HasPrefix(address, controlUnix) {
+		path := strings.TrimPrefix(address, controlUnix)
+		// socket d'une exécution précédente, jamais un autre fichier
+		if finfo, err := os.Lstat(path); err == nil {
+			if finfo.Mode()&os.ModeSocket == 0 {
+				return nil, fmt.Errorf("%s exists and is not a socket", path)
+			}
+			os.Remove(path)
+		}
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, err
+		}
+		if err := os.Chmod(path, 0600); err != nil {
+			listener.Close()
+			return nil, err
+		}
+		return listener, nil
+	}
+	if err := checkLoopback(address); err != nil {
+		return nil, err
+	}
+	return net.Listen("tcp", address)
+}
+
+// Token file of the control API, in the user's profile
+func controlTokenPath() (string, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, controlTokenName), nil
+}
+
+// Read the control token, creating it (0600) if missing
+func controlToken() (string, error) {
+	path, err := controlTokenPath()
+	if err != nil {
+		return "", err
+	}
+	finfo, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		random := make([]byte, controlTokenSize)
+		if _, err := rand.Read(random); err != nil {
+			return "", err
+		}
+		token := hex.EncodeToString(random)
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if err != nil {
+			return "", err
+		}
+		_, err = file.WriteString(token + "\n")
+		if cerr := file.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(path)
+			return "", err
+		}
+		mylog.Printf("Control API token created in %s", path)
+		return token, nil
+	}
+	if err != nil {
+		return "", err
+	}
+	// droits Windows : ACL du profil, pas de bits de mode
+	if runtime.GOOS != "windows" && finfo.Mode().Perm()&0077 != 0 {
+		return "", fmt.Errorf("Control token %s must be readable by its owner only (0600)", path)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	token := strings.TrimSpace(string(data))
+	if token == "" {
+		return "", fmt.Errorf("Control token %s is empty", path)
+	}
+	return token, nil
+}
+
+// Handler of a control API: bearer token required on TCP, not on a unix socket
+func controlHandler(address string, handler http.Handler) (http.Handler, error) {
+	if strings.HasPrefix(address, controlUnix) {
+		return handler, nil
+	}
+	token, err := controlToken()
+	if err != nil {
+		return nil, fmt.Errorf("Control API token unavailable: %v", err)
+	}
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("Bad or missing bearer token"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	}), nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.Encode(value)
+}
+
+func writeError(w http.ResponseWriter, code int, err error) {
+	writeJSON(w, code, map[string]string{"error": err.Error(), "stage": currentStage()})
+}
+
+// Current status
+func getStatus(ctx *contextCache) controlStatus {
+	status := controlStatus{
+		Job:     *ctx.job,
+		Version: VersionNum,
+		PID:     os.Getpid(),
+		Stage:   currentStage(),
+		Started: metrics.started,
+	}
+	if child := metrics.supervised(); child != nil {
+		status.Child = &childStatus{Name: child.name, PID: child.PID(), State: child.State(), Starts: child.Starts(), ExitCode: child.ExitCode()}
+	}
+	status.LastProbe, status.LastCopy = metrics.last()
+	return status
+}
+
+// Hand an action to the main loop and wait for its result
+func sendControl(ctx *contextCache, runctx context.Context, action string) controlReply {
+	req := controlRequest{action: action, reply: make(chan controlReply, 1)}
+	select {
+	case ctx.control <- req:
+	case <-time.After(controlWait * time.Second):
+		return controlReply{err: errBusy}
+	case <-runctx.Done():
+		return controlReply{err: runctx.Err()}
+	}
+	select {
+	case reply := <-req.reply:
+		return reply
+	case <-runctx.Done():
+		// la boucle principale termine l'action quand même
+		return controlReply{err: runctx.Err()}
+	}
+}
+
+// Run an action, on the main loop
+func handleControl(ctx *contextCache, req controlRequest) {
+	mylog.Printf("Control API: %s", req.action)
+	var reply controlReply
+	switch req.action {
+	case actionBackup:
+		reply.err = doBackupNCopy(ctx)
+	case actionReload:
+		reply.changed, reply.err = reloadConfig(ctx)
+	default:
+		reply.err = fmt.Errorf("Unknown action [%s]", req.action)
+	}
+	if reply.err != nil {
+		mylog.WithError(reply.err).Errorf("Control API: %s error", req.action)
+	}
+	req.reply <- reply
+}
+
+// POST handler running action on the main loop
+func actionHandler(ctx *contextCache, action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs POST", r.URL.Path))
+			return
+		}
+		reply := sendControl(ctx, r.Context(), action)
+		switch {
+		case reply.err == errBusy:
+			writeError(w, http.StatusConflict, reply.err)
+		case reply.err != nil:
+			writeError(w, http.StatusInternalServerError, reply.err)
+		default:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"action": action, "done": true, "changed": reply.changed})
+		}
+	}
+}
+
+// Start the control API on -control
+func initControl(ctx *contextCache) error {
+	ctx.control = make(chan controlRequest)
+	if *ctx.controladdr == "" {
+		return nil
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs GET", r.URL.Path))
+			return
+		}
+		writeJSON(w, http.StatusOK, getStatus(ctx))
+	})
+	mux.HandleFunc("/backup", actionHandler(ctx, actionBackup))
+	mux.HandleFunc("/reload", actionHandler(ctx, actionReload))
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("%s needs POST", r.URL.Path))
+			return
+		}
+		child := metrics.supervised()
+		if child == nil || child.State() != stateRunning {
+			writeError(w, http.StatusConflict, fmt.Errorf("External program is not running"))
+			return
+		}
+		mylog.Println("Control API: stop")
+		stopctx, cancel := context.WithTimeout(r.Context(), stopGrace*time.Second)
+		defer cancel()
+		if err := child.Stop(stopctx); err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, map[string]interface{}{"action": "stop", "done": true, "exitCode": child.ExitCode()})
+	})
+	handler, err := controlHandler(*ctx.controladdr, mux)
+	if err != nil {
+		return err
+	}
+	listener, err := controlListener(*ctx.controladdr)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for control API on %s: %v", *ctx.controladdr, err)
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			mylog.WithError(err).Error("Control API listener error")
+		}
+	}()
+	mylog.Printf("Control API on %s", listener.Addr())
+	return nil
+}
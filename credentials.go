@@ -0,0 +1,436 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/term"
+)
+
+// Mots de passe (partage, base de données) : plus de valeurs par défaut en dur,
+// plus de mot de passe sur une ligne de commande. Fournisseurs essayés dans
+// l'ordre de -credentials : variables d'environnement, trousseau du système
+// (Gestionnaire d'identification Windows, Secret Service, trousseau macOS),
+// fichier chiffré (AES-256-GCM, clé dérivée par scrypt), saisie au clavier.
+// Les secrets connus sont masqués dans tous les journaux.
+
+const credShare = "share"   // endpoint share password (-pwd)
+const credSQL = "sql"       // database password (-sqlpwd)
+const credBackup = "backup" // key of encrypted versions (-encrypt)
+
+const credEnv = "env"
+const credKeyring = "keyring"
+const credFile = "file"
+const credPrompt = "prompt"
+const credentialsdefval = "env,keyring,prompt"
+
+const credEnvPrefix = "CHECKNSTART_"
+const credKeyEnv = "CHECKNSTART_CREDKEY" // passphrase of the credential file
+const credService = "checknstart"        // keyring service name
+const credCommand = "credential"
+const credFileVersion = 1
+const redacted = "***"
+
+type (
+	// credentialProvider : source of secrets
+	credentialProvider interface {
+		Name() string
+		// Lookup : secret for key, found false if this provider does not have it
+		Lookup(key string) (string, bool, error)
+	}
+
+	// envCredentials : CHECKNSTART_SHARE_PWD, CHECKNSTART_SQL_PWD
+	envCredentials struct{}
+	// keyringCredentials : OS keyring, service checknstart, account = key
+	keyringCredentials struct{}
+	// fileCredentials : encrypted local file
+	fileCredentials struct {
+		path    string
+		secrets map[string]string
+	}
+	// promptCredentials : ask on the terminal
+	promptCredentials struct{}
+
+	// credentialFile : encrypted file layout
+	credentialFile struct {
+		Version int    `json:"version"`
+		Salt    []byte `json:"salt"`
+		Nonce   []byte `json:"nonce"`
+		Data    []byte `json:"data"`
+	}
+
+	// redactHook : replace known secrets in every log entry
+	redactHook struct {
+		mu      sync.Mutex
+		secrets []string
+	}
+)
+
+var redactor = &redactHook{}
+
+// Never log this value
+func registerSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	redactor.mu.Lock()
+	defer redactor.mu.Unlock()
+	redactor.secrets = append(redactor.secrets, secret)
+}
+
+func (h *redactHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h *redactHook) redact(value string) string {
+	for _, secret := range h.secrets {
+		value = strings.Replace(value, secret, redacted, -1)
+	}
+	return value
+}
+
+func (h *redactHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if len(h.secrets) == 0 {
+		return nil
+	}
+	entry.Message = h.redact(entry.Message)
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = h.redact(v)
+		case error:
+			entry.Data[key] = h.redact(v.Error())
+		}
+	}
+	return nil
+}
+
+// Environment variable of a key
+func credEnvName(key string) string {
+	return fmt.Sprintf("%s%s_PWD", credEnvPrefix, strings.ToUpper(key))
+}
+
+func (envCredentials) Name() string { return credEnv }
+
+func (envCredentials) Lookup(key string) (string, bool, error) {
+	secret, found := os.LookupEnv(credEnvName(key))
+	return secret, found && secret != "", nil
+}
+
+func (keyringCredentials) Name() string { return credKeyring }
+
+func (keyringCredentials) Lookup(key string) (string, bool, error) {
+	return keyringLookup(credService, key)
+}
+
+func (promptCredentials) Name() string { return credPrompt }
+
+func (promptCredentials) Lookup(key string) (string, bool, error) {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", false, nil
+	}
+	secret, err := readSecret(fmt.Sprintf("Password for %s: ", key))
+	return secret, err == nil && secret != "", err
+}
+
+// Read a secret on the terminal, without echo
+func readSecret(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	secret, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	return string(secret), err
+}
+
+func (f *fileCredentials) Name() string { return credFile }
+
+func (f *fileCredentials) Lookup(key string) (string, bool, error) {
+	if f.secrets == nil {
+		passphrase, err := credentialPassphrase(false)
+		if err != nil {
+			return "", false, err
+		}
+		if f.secrets, err = readCredentialFile(f.path, passphrase); err != nil {
+			return "", false, err
+		}
+	}
+	secret, found := f.secrets[key]
+	return secret, found, nil
+}
+
+// Passphrase of the credential file: CHECKNSTART_CREDKEY, or terminal
+func credentialPassphrase(confirm bool) (string, error) {
+	if passphrase := os.Getenv(credKeyEnv); passphrase != "" {
+		return passphrase, nil
+	}
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return "", fmt.Errorf("Credential file needs %s, or a terminal", credKeyEnv)
+	}
+	passphrase, err := readSecret("Credential file passphrase: ")
+	if err != nil || !confirm {
+		return passphrase, err
+	}
+	again, err := readSecret("Again: ")
+	if err != nil {
+		return "", err
+	}
+	if again != passphrase {
+		return "", errors.New("Passphrases do not match")
+	}
+	return passphrase, nil
+}
+
+// AES-256-GCM with a scrypt key
+func credentialCipher(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Decrypt a credential file
+func readCredentialFile(path, passphrase string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var file credentialFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("Bad credential file %s: %v", path, err)
+	}
+	if file.Version != credFileVersion {
+		return nil, fmt.Errorf("Credential file %s version %d not supported", path, file.Version)
+	}
+	aead, err := credentialCipher(passphrase, file.Salt)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, file.Nonce, file.Data, []byte(credService))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to decrypt %s (bad passphrase?)", path)
+	}
+	secrets := make(map[string]string)
+	err = json.Unmarshal(plain, &secrets)
+	return secrets, err
+}
+
+// Encrypt and write a credential file, readable by its owner only
+func writeCredentialFile(path, passphrase string, secrets map[string]string) error {
+	plain, err := json.Marshal(secrets)
+	if err != nil {
+		return err
+	}
+	file := credentialFile{Version: credFileVersion, Salt: make([]byte, 16)}
+	if _, err := io.ReadFull(rand.Reader, file.Salt); err != nil {
+		return err
+	}
+	aead, err := credentialCipher(passphrase, file.Salt)
+	if err != nil {
+		return err
+	}
+	file.Nonce = make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, file.Nonce); err != nil {
+		return err
+	}
+	file.Data = aead.Seal(nil, file.Nonce, plain, []byte(credService))
+	data, err := json.Marshal(file)
+	if err != nil {
+		return err
+	}
+	tmpname := path + ".tmp"
+	if err := ioutil.WriteFile(tmpname, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpname, path)
+}
+
+// Providers of -credentials
+func newCredentialProviders(ctx *contextCache) ([]credentialProvider, error) {
+	var providers []credentialProvider
+	for _, name := range strings.Split(*ctx.credentials, ",") {
+		switch strings.TrimSpace(name) {
+		case credEnv:
+			providers = append(providers, envCredentials{})
+		case credKeyring:
+			providers = append(providers, keyringCredentials{})
+		case credFile:
+			if *ctx.credfile == "" {
+				return nil, fmt.Errorf("Credential provider %s needs -credfile", credFile)
+			}
+			providers = append(providers, &fileCredentials{path: *ctx.credfile})
+		case credPrompt:
+			providers = append(providers, promptCredentials{})
+		case "":
+		default:
+			return nil, fmt.Errorf("Unknown credential provider [%s] (%s|%s|%s|%s)", name, credEnv, credKeyring, credFile, credPrompt)
+		}
+	}
+	return providers, nil
+}
+
+// First provider having key
+func lookupSecret(providers []credentialProvider, key string) (string, string, error) {
+	for _, provider := range providers {
+		secret, found, err := provider.Lookup(key)
+		if err != nil {
+			mylog.WithError(err).Warnf("Credential provider %s", provider.Name())
+			continue
+		}
+		if found {
+			return secret, provider.Name(), nil
+		}
+	}
+	return "", "", fmt.Errorf("No %s password: set %s, store it with \"%s %s %s\", or use -credentials", key, credEnvName(key), logFileName, credCommand, key)
+}
+
+// Is a flag given on the command line?
+func flagGiven(name string) bool {
+	given := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			given = true
+		}
+	})
+	return given
+}
+
+// Resolve a password flag from the providers when not set
+func resolveSecret(ctx *contextCache, providers []credentialProvider, key string, value *string, flagname string) error {
+	if *value != "" {
+		if flagGiven(flagname) {
+			mylog.Printf("WARNING -%s is visible in the process list, prefer -credentials (%s)", flagname, credEnvName(key))
+		}
+		registerSecret(*value)
+		return nil
+	}
+	secret, source, err := lookupSecret(providers, key)
+	if err != nil {
+		return err
+	}
+	*value = secret
+	registerSecret(secret)
+	if *ctx.verbose {
+		mylog.Printf("%s password from %s", key, source)
+	}
+	return nil
+}
+
+// Resolve the passwords needed by this configuration
+func initCredentials(ctx *contextCache) error {
+	providers, err := newCredentialProviders(ctx)
+	if err != nil {
+		return err
+	}
+	if *ctx.share != "" || *ctx.endpoint != "" {
+		if err := resolveSecret(ctx, providers, credShare, ctx.pwd, "pwd"); err != nil {
+			return err
+		}
+	}
+	switch ctx.provider.Name() {
+	case providerSQLAnywhere, providerPgDump, providerMySQLDump:
+		if err := resolveSecret(ctx, providers, credSQL, ctx.backuppwd, "sqlpwd"); err != nil {
+			return err
+		}
+	}
+	// clé des fichiers chiffrés : tout de suite avec -encrypt, sinon à la première lecture
+	atrest.lookup = func() (string, error) {
+		secret, source, err := lookupSecret(providers, credBackup)
+		if err != nil {
+			return "", err
+		}
+		registerSecret(secret)
+		if *ctx.verbose {
+			mylog.Printf("%s password from %s", credBackup, source)
+		}
+		return secret, nil
+	}
+	if *ctx.encrypt {
+		if _, err := atrest.get(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checknstart credential [-store keyring|file] [-file path] share|sql|backup
+// The secret is read on the terminal (or stdin), never from the command line.
+func runCredentialCommand(args []string) int {
+	flags := flag.NewFlagSet(credCommand, flag.ContinueOnError)
+	store := flags.String("store", credKeyring, "Where to store the secret (keyring|file)")
+	path := flags.String("file", "", "Credential file, for -store file")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if flags.NArg() != 1 || (flags.Arg(0) != credShare && flags.Arg(0) != credSQL && flags.Arg(0) != credBackup) {
+		fmt.Fprintf(os.Stderr, "usage: %s %s [-store keyring|file] [-file path] %s|%s|%s\n", logFileName, credCommand, credShare, credSQL, credBackup)
+		return 1
+	}
+	key := flags.Arg(0)
+	var secret string
+	var err error
+	if term.IsTerminal(int(os.Stdin.Fd())) {
+		secret, err = readSecret(fmt.Sprintf("Password for %s: ", key))
+	} else {
+		secret, err = bufio.NewReader(os.Stdin).ReadString('\n')
+		if err == io.EOF {
+			err = nil
+		}
+		secret = strings.TrimRight(secret, "\r\n")
+	}
+	if err == nil && secret == "" {
+		err = errors.New("Empty password")
+	}
+	if err == nil {
+		switch *store {
+		case credKeyring:
+			err = keyringStore(credService, key, secret)
+		case credFile:
+			err = storeInFile(*path, key, secret)
+		default:
+			err = fmt.Errorf("Unknown store [%s] (%s|%s)", *store, credKeyring, credFile)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintf(os.Stderr, "%s password stored (%s)\n", key, *store)
+	return 0
+}
+
+// Add or replace a secret in the credential file
+func storeInFile(path, key, secret string) error {
+	if path == "" {
+		return fmt.Errorf("-store %s needs -file", credFile)
+	}
+	secrets := make(map[string]string)
+	_, err := os.Stat(path)
+	passphrase, perr := credentialPassphrase(os.IsNotExist(err))
+	if perr != nil {
+		return perr
+	}
+	if err == nil {
+		if secrets, err = readCredentialFile(path, passphrase); err != nil {
+			return err
+		}
+	}
+	secrets[key] = secret
+	return writeCredentialFile(path, passphrase, secrets)
+}
@@ -0,0 +1,55 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Trousseau : Secret Service (secret-tool) sous Linux, security sous macOS
+
+// Secret of key in the keyring, not found if no keyring tool
+func keyringLookup(service, key string) (string, bool, error) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "darwin" {
+		cmd = exec.Command("security", "find-generic-password", "-s", service, "-a", key, "-w")
+	} else {
+		cmd = exec.Command("secret-tool", "lookup", "service", service, "account", key)
+	}
+	if _, err := exec.LookPath(cmd.Path); err != nil {
+		return "", false, nil
+	}
+	out, err := cmd.Output()
+	if err != nil {
+		// absent du trousseau : code retour non nul
+		var exiterr *exec.ExitError
+		if errors.As(err, &exiterr) {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	secret := strings.TrimRight(string(out), "\r\n")
+	return secret, secret != "", nil
+}
+
+// Store the secret of key in the keyring; the secret goes through stdin
+func keyringStore(service, key, secret string) error {
+	if runtime.GOOS == "darwin" {
+		// security ne lit le secret que sur la ligne de commande ou le terminal
+		return fmt.Errorf("Store %s with Keychain Access (service %s, account %s), or use -store %s", key, service, key, credFile)
+	}
+	cmd := exec.Command("secret-tool", "store", "--label", fmt.Sprintf("%s %s", service, key), "service", service, "account", key)
+	cmd.Stdin = strings.NewReader(secret)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Unable to store %s with secret-tool: %v %s", key, err, strings.TrimSpace(stderr.String()))
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"strings"
+
+	"golang.org/x/sys/windows"
+)
+
+// Free bytes available to the user on the volume of path (UNC paths too)
+func diskFree(path string) (uint64, error) {
+	// chemin UNC : barre finale obligatoire pour la racine du partage
+	if strings.HasPrefix(path, `\\`) && !strings.HasSuffix(path, `\`) {
+		path += `\`
+	}
+	name, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+	var free, total, totalfree uint64
+	if err := windows.GetDiskFreeSpaceEx(name, &free, &total, &totalfree); err != nil {
+		return 0, err
+	}
+	return free, nil
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Commande "checknstart doctor [options habituelles] [-json]" : chaque contrôle
+// est fait avec la configuration courante, rapport réussi / échec avec une
+// piste de correction, ou JSON pour l'automatisation.
+
+const doctorCommand = "doctor"
+const doctorTimeout = 5 // seconds for network checks
+
+const checkPass = "pass"
+const checkWarn = "warn"
+const checkFail = "fail"
+const checkSkip = "skip"
+
+type (
+	// doctorCheck : result of one check
+	doctorCheck struct {
+		Name   string `json:"name"`
+		Status string `json:"status"`
+		Detail string `json:"detail"`
+		Hint   string `json:"hint,omitempty"`
+	}
+
+	// doctorReport : all checks
+	doctorReport struct {
+		Version string        `json:"version"`
+		Host    string        `json:"host"`
+		At      time.Time     `json:"at"`
+		Passed  bool          `json:"passed"`
+		Checks  []doctorCheck `json:"checks"`
+	}
+)
+
+func (r *doctorReport) add(name, status, detail, hint string) {
+	if status == checkFail {
+		r.Passed = false
+	}
+	if status == checkPass {
+		hint = ""
+	}
+	r.Checks = append(r.Checks, doctorCheck{Name: name, Status: status, Detail: detail, Hint: hint})
+}
+
+// Can we create a file in dir?
+func checkWritable(dir string) error {
+	file, err := ioutil.TempFile(dir, fmt.Sprintf("%s-doctor-", logFileName))
+	if err != nil {
+		return err
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// Check free space of dir against need
+func (r *doctorReport) freeSpace(name, dir string, need uint64, hint string) {
+	free, err := diskFree(dir)
+	switch {
+	case err != nil:
+		r.add(name, checkWarn, fmt.Sprintf("Unable to get free space of %s: %v", dir, err), hint)
+	case free < need:
+		r.add(name, checkFail, fmt.Sprintf("%s free on %s, %s needed", humanize.Bytes(free), dir, humanize.Bytes(need)), hint)
+	default:
+		r.add(name, checkPass, fmt.Sprintf("%s free on %s, %s needed", humanize.Bytes(free), dir, humanize.Bytes(need)), hint)
+	}
+}
+
+// Check an executable
+func (r *doctorReport) executable(name, tool, hint string) {
+	if tool == "" {
+		r.add(name, checkFail, "No executable configured", hint)
+		return
+	}
+	if path, err := exec.LookPath(tool); err != nil {
+		r.add(name, checkFail, err.Error(), hint)
+	} else {
+		r.add(name, checkPass, path, hint)
+	}
+}
+
+// Run every check of the current configuration
+func runDoctor(ctx *contextCache) *doctorReport {
+	host, _ := os.Hostname()
+	r := &doctorReport{Version: VersionNum, Host: host, At: time.Now(), Passed: true}
+	r.add("config", checkPass, fmt.Sprintf("job %s, provider %s, signal %s", *ctx.job, ctx.provider.Name(), ctx.signal), "")
+
+	// réseau et partage
+	if *ctx.endpoint == "" {
+		r.add("port445", checkSkip, "No -endpoint, remote file is a local path", "")
+		r.add("share", checkSkip, "No -endpoint", "")
+	} else {
+		address := net.JoinHostPort(*ctx.endpoint, strconv.Itoa(portCheck))
+		if conn, err := net.DialTimeout("tcp", address, doctorTimeout*time.Second); err != nil {
+			r.add("port445", checkFail, err.Error(),
+				fmt.Sprintf("Check that %s is on, file sharing is enabled and its firewall allows SMB (TCP %d)", *ctx.endpoint, portCheck))
+		} else {
+			conn.Close()
+			r.add("port445", checkPass, fmt.Sprintf("%s reachable", address), "")
+		}
+		share := fmt.Sprintf("\\\\%s\\%s", *ctx.endpoint, *ctx.share)
+		if runtime.GOOS != "windows" {
+			r.add("share", checkSkip, "Share mapping is only done on Windows", "")
+		} else if err := mapDrive(share, *ctx.user, *ctx.pwd, false); err != nil {
+			r.add("share", checkFail, err.Error(),
+				fmt.Sprintf("Check -user, the %s password (-credentials) and that share %s exists and is granted to %s", credShare, share, *ctx.user))
+		} else {
+			r.add("share", checkPass, fmt.Sprintf("%s mapped as %s", share, *ctx.user), "")
+		}
+	}
+
+	// fichiers
+	remote := getRemotePath(ctx)
+	var remotesize, localsize uint64
+	if finfo, err := getFileSpec(remote, "remote", false); err != nil {
+		r.add("remotefile", checkFail, err.Error(), "Check -remotefile, and that the endpoint database is in place")
+	} else {
+		remotesize = uint64(finfo.Size())
+		r.add("remotefile", checkPass, fmt.Sprintf("%s, %s, modified %s", remote, humanize.Bytes(remotesize), finfo.ModTime().Format(time.RFC3339)), "")
+	}
+	if finfo, err := getFileSpec(*ctx.localname, "local", false); err != nil {
+		r.add("localfile", checkFail, err.Error(), "Check -localfile; the first run needs an existing local database")
+	} else {
+		localsize = uint64(finfo.Size())
+		r.add("localfile", checkPass, fmt.Sprintf("%s, %s, modified %s", *ctx.localname, humanize.Bytes(localsize), finfo.ModTime().Format(time.RFC3339)), "")
+	}
+	if *ctx.localempty == "" {
+		r.add("emptyfile", checkWarn, "No -localempty, remote database will not be emptied after retrieval", "Set -localempty to an empty database")
+	} else if _, err := getFileSpec(*ctx.localempty, "empty", false); err != nil {
+		r.add("emptyfile", checkFail, err.Error(), "Check -localempty")
+	} else {
+		r.add("emptyfile", checkPass, *ctx.localempty, "")
+	}
+	localdir := filepath.Dir(*ctx.localname)
+	if err := checkWritable(localdir); err != nil {
+		r.add("localdir", checkFail, err.Error(), fmt.Sprintf("Grant write access on %s (versions are renamed there)", localdir))
+	} else {
+		r.add("localdir", checkPass, fmt.Sprintf("%s writable", localdir), "")
+	}
+
+	// espace disque : copie du distant en local, sauvegarde temporaire
+	r.freeSpace("diskfree-local", localdir, remotesize, fmt.Sprintf("Free space on %s, or lower MAX_VERSION", localdir))
+	workdir := workdirBase(ctx)
+	if err := checkWritable(workdir); err != nil {
+		r.add("workdir", checkFail, err.Error(), "Set -workdir (or TEMP) to a writable directory")
+	} else {
+		r.add("workdir", checkPass, fmt.Sprintf("%s writable", workdir), "")
+	}
+	r.freeSpace("diskfree-workdir", workdir, localsize, "Free space in the work directory, or set -workdir elsewhere")
+
+	// outils
+	r.executable("backuptool", ctx.provider.Tool(ctx), fmt.Sprintf("Install %s tool, or set -sqlcmd", ctx.provider.Name()))
+	if *ctx.validcmd != "" {
+		r.executable("validtool", *ctx.validcmd, "Install the validation tool, or fix -validcmd")
+	}
+	r.executable("command", *ctx.cmd, "Fix -cmd (external program)")
+
+	// signal
+	if ready, err := ctx.signal.Ready(); err != nil {
+		r.add("signal", checkFail, err.Error(), "Check -signal / -regkey and that the source is readable by this user")
+	} else {
+		r.add("signal", checkPass, fmt.Sprintf("%s readable, currently %v", ctx.signal, ready), "")
+	}
+
+	// journaux
+	if err := checkWritable(logDir(ctx)); err != nil {
+		r.add("logdir", checkFail, err.Error(), "Set -logdir to a writable directory")
+	} else {
+		r.add("logdir", checkPass, fmt.Sprintf("%s writable", logDir(ctx)), "")
+	}
+	return r
+}
+
+// Print report, text or JSON. Returns exit code.
+func printDoctor(r *doctorReport, asjson bool) int {
+	if asjson {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(r)
+	} else {
+		for _, check := range r.Checks {
+			fmt.Printf("[%-4s] %-17s %s\n", check.Status, check.Name, check.Detail)
+			if check.Hint != "" {
+				fmt.Printf("       %-17s -> %s\n", "", check.Hint)
+			}
+		}
+		if r.Passed {
+			fmt.Println("All checks passed.")
+		} else {
+			fmt.Println("Some checks failed.")
+		}
+	}
+	for _, check := range r.Checks {
+		mylog.WithField("check", check.Name).Printf("doctor %s: %s", check.Status, check.Detail)
+	}
+	if !r.Passed {
+		return 1
+	}
+	return 0
+}
+
+// checknstart doctor: usual options, plus -json
+func runDoctorCommand(ctx *contextCache, args []string) int {
+	asjson := false
+	var rest []string
+	for _, arg := range args {
+		if arg == "-json" || arg == "--json" {
+			asjson = true
+			continue
+		}
+		rest = append(rest, arg)
+	}
+	os.Args = append([]string{os.Args[0]}, rest...)
+	// le rappel des limites (verbose) ne doit pas se mêler au JSON
+	stdout := os.Stdout
+	if asjson {
+		os.Stdout = os.Stderr
+	}
+	err := processArgs(ctx)
+	os.Stdout = stdout
+	if err != nil {
+		r := &doctorReport{Version: VersionNum, At: time.Now(), Passed: true}
+		r.Host, _ = os.Hostname()
+		r.add("config", checkFail, err.Error(), "Fix command line options or -config file")
+		return printDoctor(r, asjson)
+	}
+	ctx.runctx = context.Background()
+	code := printDoctor(runDoctor(ctx), asjson)
+	closeLogging(ctx)
+	return code
+}
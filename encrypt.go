@@ -0,0 +1,309 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+)
+
+// Chiffrement au repos (-encrypt) des versions protégées locales et des
+// sauvegardes temporaires. AES-256-GCM par blocs de
+// 64 Kio, clé dérivée par scrypt du mot de passe "backup" (fournisseurs de
+// -credentials) avec un sel par fichier. Compression puis chiffrement ; la
+// lecture (restauration, retour arrière) déchiffre sans option.
+// Les versions distantes restent en clair : le poste physique doit pouvoir
+// reprendre sa base.
+// La sauvegarde temporaire est écrite en clair par l'outil (dbbackup, pg_dump...)
+// et relue en clair par -validate : elle est chiffrée dès sa validation, puis
+// déchiffrée à la volée pendant la recopie. Elle reste donc en clair pendant la
+// sauvegarde et la validation, et après un arrêt brutal à ce moment là.
+
+const encryptName = "aes256gcm"
+const encryptFormat = 1
+const encryptChunk = 64 * 1024
+const encryptSaltSize = 16
+const encryptPrefixSize = 7 // nonce: prefix, chunk counter (4), last chunk flag (1)
+
+var encryptMagic = []byte{'C', 'N', 'S', 'E'}
+
+type (
+	// atRestKey : backup password, looked up on first use
+	atRestKey struct {
+		mu         sync.Mutex
+		lookup     func() (string, error)
+		passphrase string
+	}
+
+	// sealWriter : encrypt a stream chunk by chunk
+	sealWriter struct {
+		w       io.Writer
+		aead    cipher.AEAD
+		header  []byte
+		prefix  []byte
+		counter uint32
+		buf     []byte
+	}
+
+	// openReader : decrypt a stream written by sealWriter
+	openReader struct {
+		r       *bufio.Reader
+		aead    cipher.AEAD
+		header  []byte
+		prefix  []byte
+		counter uint32
+		chunk   []byte
+		plain   []byte
+		done    bool
+	}
+)
+
+var atrest = &atRestKey{}
+
+// Backup password, from the credential providers
+func (k *atRestKey) get() (string, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.passphrase != "" {
+		return k.passphrase, nil
+	}
+	if k.lookup == nil {
+		return "", fmt.Errorf("No %s password for encrypted files", credBackup)
+	}
+	passphrase, err := k.lookup()
+	if err != nil {
+		return "", err
+	}
+	k.passphrase = passphrase
+	return passphrase, nil
+}
+
+// Nonce of chunk counter
+func chunkNonce(prefix []byte, counter uint32, last bool) []byte {
+	nonce := make([]byte, encryptPrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[encryptPrefixSize:], counter)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	return nonce
+}
+
+// Wrap a writer with encryption; header written now, last chunk on Close
+func newEncryptWriter(w io.Writer) (io.WriteCloser, error) {
+	passphrase, err := atrest.get()
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, len(encryptMagic)+1+encryptSaltSize+encryptPrefixSize)
+	copy(header, encryptMagic)
+	header[len(encryptMagic)] = encryptFormat
+	if _, err := io.ReadFull(rand.Reader, header[len(encryptMagic)+1:]); err != nil {
+		return nil, err
+	}
+	salt := header[len(encryptMagic)+1 : len(encryptMagic)+1+encryptSaltSize]
+	aead, err := credentialCipher(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &sealWriter{w: w, aead: aead, header: header, prefix: header[len(header)-encryptPrefixSize:],
+		buf: make([]byte, 0, encryptChunk)}, nil
+}
+
+func (s *sealWriter) seal(last bool) error {
+	if s.counter == math.MaxUint32 {
+		return errors.New("File too large to encrypt")
+	}
+	out := s.aead.Seal(nil, chunkNonce(s.prefix, s.counter, last), s.buf, s.header)
+	s.counter++
+	s.buf = s.buf[:0]
+	_, err := s.w.Write(out)
+	return err
+}
+
+func (s *sealWriter) Write(p []byte) (int, error) {
+	n := 0
+	for len(p) > 0 {
+		// bloc plein : scellé seulement quand la suite arrive, le dernier est marqué
+		if len(s.buf) == encryptChunk {
+			if err := s.seal(false); err != nil {
+				return n, err
+			}
+		}
+		k := copy(s.buf[len(s.buf):encryptChunk], p)
+		s.buf = s.buf[:len(s.buf)+k]
+		p = p[k:]
+		n += k
+	}
+	return n, nil
+}
+
+// Close seals the last chunk; the underlying writer stays open
+func (s *sealWriter) Close() error {
+	return s.seal(true)
+}
+
+// Is the stream encrypted?
+func isEncrypted(br *bufio.Reader) bool {
+	head, _ := br.Peek(len(encryptMagic))
+	return bytes.Equal(head, encryptMagic)
+}
+
+// Wrap an encrypted stream with decryption
+func newDecryptReader(br *bufio.Reader) (io.Reader, error) {
+	header := make([]byte, len(encryptMagic)+1+encryptSaltSize+encryptPrefixSize)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("Encrypted file header unreadable: %v", err)
+	}
+	if header[len(encryptMagic)] != encryptFormat {
+		return nil, fmt.Errorf("Encrypted file version %d not supported", header[len(encryptMagic)])
+	}
+	passphrase, err := atrest.get()
+	if err != nil {
+		return nil, err
+	}
+	aead, err := credentialCipher(passphrase, header[len(encryptMagic)+1:len(encryptMagic)+1+encryptSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{r: br, aead: aead, header: header, prefix: header[len(header)-encryptPrefixSize:],
+		chunk: make([]byte, encryptChunk+aead.Overhead())}, nil
+}
+
+func (o *openReader) next() error {
+	n, err := io.ReadFull(o.r, o.chunk)
+	last := false
+	switch {
+	case err == io.EOF || err == io.ErrUnexpectedEOF:
+		last = true
+	case err != nil:
+		return err
+	default:
+		if _, perr := o.r.Peek(1); perr == io.EOF {
+			last = true
+		} else if perr != nil {
+			return perr
+		}
+	}
+	plain, err := o.aead.Open(nil, chunkNonce(o.prefix, o.counter, last), o.chunk[:n], o.header)
+	if err != nil {
+		return errors.New("Encrypted file is truncated, corrupted, or the backup password is wrong")
+	}
+	o.counter++
+	o.plain = plain
+	o.done = last
+	return nil
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.plain) == 0 {
+		if o.done {
+			return 0, io.EOF
+		}
+		if err := o.next(); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, o.plain)
+	o.plain = o.plain[n:]
+	return n, nil
+}
+
+// Encrypt a file in place, modification time kept
+func encryptFile(path string) (raw int64, stored int64, err error) {
+	return rewriteFile(path, encryptName, newEncryptWriter)
+}
+
+// Encrypt a protected version if -encrypt
+func encryptVersion(ctx *contextCache, path string) error {
+	if !*ctx.encrypt {
+		return nil
+	}
+	start := time.Now()
+	raw, stored, err := encryptFile(path)
+	if err != nil {
+		return fmt.Errorf("Unable to encrypt version %s: %v", path, err)
+	}
+	if *ctx.verbose {
+		mylog.WithFields(logrus.Fields{
+			fieldFile:     path,
+			fieldBytes:    raw,
+			fieldDuration: time.Since(start).Seconds(),
+			"stored":      stored,
+			"storedHuman": humanize.Bytes(uint64(stored)),
+			"encrypt":     encryptName,
+		}).Info(fmt.Sprintf("encrypted version %s", path))
+	}
+	return nil
+}
+
+// Encrypt the validated temporary backup if -encrypt, before its copy to the remote
+func encryptBackup(ctx *contextCache, path string) error {
+	if !*ctx.encrypt {
+		return nil
+	}
+	if _, _, err := encryptFile(path); err != nil {
+		return fmt.Errorf("Unable to encrypt backup %s: %v", path, err)
+	}
+	if *ctx.verbose {
+		mylog.Printf("Encrypted backup %s", path)
+	}
+	return nil
+}
+
+// Open a file, decrypting it if encrypted (no decompression)
+func openPlain(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	br := bufio.NewReader(file)
+	if !isEncrypted(br) {
+		return &readCloserChain{Reader: br, closers: []func() error{file.Close}}, nil
+	}
+	dr, err := newDecryptReader(br)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &readCloserChain{Reader: dr, closers: []func() error{file.Close}}, nil
+}
+
+// Encrypt every file of a kept work directory if -encrypt
+func encryptWorkdir(ctx *contextCache, dir string) error {
+	if !*ctx.encrypt {
+		return nil
+	}
+	return filepath.Walk(dir, func(path string, finfo os.FileInfo, err error) error {
+		if err != nil || !finfo.Mode().IsRegular() {
+			return err
+		}
+		if file, err := os.Open(path); err != nil {
+			return err
+		} else if encrypted := isEncrypted(bufio.NewReader(file)); file.Close() != nil || encrypted {
+			return nil
+		}
+		if _, _, err := encryptFile(path); err != nil {
+			return fmt.Errorf("Unable to encrypt %s: %v", path, err)
+		}
+		if *ctx.verbose {
+			mylog.Printf("Encrypted kept file %s", path)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Historique des exécutions : une ligne JSON par exécution, ajoutée en fin de
+// fichier (checknstart-history.jsonl dans -logdir), et commande
+// "checknstart history" pour la consulter (liste filtrée ou synthèse par site).
+
+const historyName = "history.jsonl"
+const historyCommand = "history"
+const historylastdefval = 20
+
+type (
+	// stageRecord : one stage of a run
+	stageRecord struct {
+		Name     string    `json:"name"`
+		Start    time.Time `json:"start"`
+		Duration float64   `json:"duration"`
+	}
+
+	// runRecord : outcome of one run
+	runRecord struct {
+		ID       string        `json:"id"`
+		Job      string        `json:"job"`
+		Host     string        `json:"host"`
+		User     string        `json:"user"`
+		Endpoint string        `json:"endpoint"`
+		Version  string        `json:"version"`
+		Start    time.Time     `json:"start"`
+		End      time.Time     `json:"end"`
+		Duration float64       `json:"duration"`
+		Stages   []stageRecord `json:"stages"`
+		BytesGet int64         `json:"bytesGet"`
+		BytesPut int64         `json:"bytesPut"`
+		CopyTime float64       `json:"copyTime"`
+		Versions []string      `json:"versions,omitempty"`
+		ExitCode int           `json:"exitCode"`
+		Errors   []string      `json:"errors,omitempty"`
+	}
+
+	// runHistory : record of the current run
+	runHistory struct {
+		mu     sync.Mutex
+		path   string
+		record runRecord
+	}
+)
+
+// Record of the current run, nil until startHistory
+var history *runHistory
+
+// History file: -history, or checknstart-history.jsonl in the log directory
+func historyPath(ctx *contextCache) string {
+	if *ctx.history != "" {
+		return *ctx.history
+	}
+	return filepath.Join(logDir(ctx), fmt.Sprintf("%s-%s", logFileName, historyName))
+}
+
+// Start recording this run
+func startHistory(ctx *contextCache) {
+	host, _ := os.Hostname()
+	owner := ownLockInfo()
+	history = &runHistory{
+		path: historyPath(ctx),
+		record: runRecord{
+			ID:       ctx.tag,
+			Job:      *ctx.job,
+			Host:     host,
+			User:     owner.User,
+			Endpoint: *ctx.endpoint,
+			Version:  VersionNum,
+			Start:    time.Now(),
+		},
+	}
+	history.stage(currentStage())
+}
+
+// New stage: close the current one
+func (h *runHistory) stage(name string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := time.Now()
+	if last := len(h.record.Stages) - 1; last >= 0 {
+		if h.record.Stages[last].Name == name {
+			return
+		}
+		h.record.Stages[last].Duration = now.Sub(h.record.Stages[last].Start).Seconds()
+	}
+	h.record.Stages = append(h.record.Stages, stageRecord{Name: name, Start: now})
+}
+
+// Bytes copied from (get) or to (put) the endpoint
+func (h *runHistory) transfer(get bool, bytes int64, elapsed time.Duration) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if get {
+		h.record.BytesGet += bytes
+	} else {
+		h.record.BytesPut += bytes
+	}
+	h.record.CopyTime += elapsed.Seconds()
+}
+
+// Protected version created
+func (h *runHistory) version(path string) {
+	if h == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.record.Versions = append(h.record.Versions, path)
+}
+
+// Error met during the run
+func (h *runHistory) fail(err error) {
+	if h == nil || err == nil {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.record.Errors = append(h.record.Errors, err.Error())
+}
+
+// Close the run and append it to the history file
+func (h *runHistory) finish(code int) error {
+	if h == nil {
+		return nil
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.record.End = time.Now()
+	if last := len(h.record.Stages) - 1; last >= 0 {
+		h.record.Stages[last].Duration = h.record.End.Sub(h.record.Stages[last].Start).Seconds()
+	}
+	h.record.Duration = h.record.End.Sub(h.record.Start).Seconds()
+	h.record.ExitCode = code
+	data, err := json.Marshal(h.record)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	// une seule écriture par ligne, pour ne pas mélanger deux exécutions
+	_, err = file.Write(append(data, '\n'))
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Read runs of a history file, skipping damaged lines
+func readHistory(path string) ([]runRecord, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var runs []runRecord
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	for scanner.Scan() {
+		var run runRecord
+		if err := json.Unmarshal(scanner.Bytes(), &run); err != nil {
+			continue
+		}
+		runs = append(runs, run)
+	}
+	return runs, scanner.Err()
+}
+
+// historyFilter : history command selection
+type historyFilter struct {
+	job    string
+	host   string
+	since  time.Time
+	failed bool
+	last   int
+}
+
+func (f historyFilter) keep(run runRecord) bool {
+	if f.job != "" && !strings.EqualFold(run.Job, f.job) {
+		return false
+	}
+	if f.host != "" && !strings.EqualFold(run.Host, f.host) && !strings.EqualFold(run.Endpoint, f.host) {
+		return false
+	}
+	if !f.since.IsZero() && run.Start.Before(f.since) {
+		return false
+	}
+	return !f.failed || run.ExitCode != 0
+}
+
+// Parse -since: number of days, or date (yyyy-mm-dd)
+func parseSince(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	var days int
+	if _, err := fmt.Sscanf(value, "%d", &days); err == nil && !strings.Contains(value, "-") {
+		return time.Now().AddDate(0, 0, -days), nil
+	}
+	since, err := time.ParseInLocation("2006-01-02", value, time.Local)
+	if err != nil {
+		return since, fmt.Errorf("Bad -since [%s] (days or yyyy-mm-dd)", value)
+	}
+	return since, nil
+}
+
+// Names of the stages of a run
+func stageNames(run runRecord) string {
+	names := make([]string, 0, len(run.Stages))
+	for _, stage := range run.Stages {
+		names = append(names, stage.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+// List runs, newest last
+func printRuns(out io.Writer, runs []runRecord) {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "START\tJOB\tHOST\tDURATION\tEXIT\tGET\tPUT\tSTAGES\tERROR")
+	for _, run := range runs {
+		errmsg := ""
+		if len(run.Errors) > 0 {
+			errmsg = run.Errors[len(run.Errors)-1]
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%v\t%d\t%s\t%s\t%s\t%s\n", run.Start.Format("2006-01-02 15:04:05"),
+			run.Job, run.Host, time.Duration(run.Duration*float64(time.Second)).Round(time.Second), run.ExitCode,
+			humanize.Bytes(uint64(run.BytesGet)), humanize.Bytes(uint64(run.BytesPut)), stageNames(run), errmsg)
+	}
+	tw.Flush()
+}
+
+// historySummary : statistics of a job on a site
+type historySummary struct {
+	Job      string    `json:"job"`
+	Site     string    `json:"site"`
+	Runs     int       `json:"runs"`
+	Failures int       `json:"failures"`
+	Rate     float64   `json:"failureRate"`
+	Bytes    int64     `json:"bytes"`
+	CopyTime float64   `json:"copyTime"`
+	AvgCopy  float64   `json:"avgCopyTime"`
+	MaxCopy  float64   `json:"maxCopyTime"`
+	Speed    float64   `json:"bytesPerSecond"`
+	Last     time.Time `json:"last"`
+	LastExit int       `json:"lastExit"`
+}
+
+// Summary per job and site (endpoint, or host without endpoint)
+func summarize(runs []runRecord) []*historySummary {
+	var summaries []*historySummary
+	find := func(job, site string) *historySummary {
+		for _, summary := range summaries {
+			if summary.Job == job && summary.Site == site {
+				return summary
+			}
+		}
+		summary := &historySummary{Job: job, Site: site}
+		summaries = append(summaries, summary)
+		return summary
+	}
+	var copies = make(map[*historySummary]int)
+	for _, run := range runs {
+		site := run.Endpoint
+		if site == "" {
+			site = run.Host
+		}
+		summary := find(run.Job, site)
+		summary.Runs++
+		if run.ExitCode != 0 {
+			summary.Failures++
+		}
+		summary.Bytes += run.BytesGet + run.BytesPut
+		summary.CopyTime += run.CopyTime
+		if run.CopyTime > 0 {
+			copies[summary]++
+		}
+		if run.CopyTime > summary.MaxCopy {
+			summary.MaxCopy = run.CopyTime
+		}
+		if !run.Start.Before(summary.Last) {
+			summary.Last = run.Start
+			summary.LastExit = run.ExitCode
+		}
+	}
+	for _, summary := range summaries {
+		summary.Rate = float64(summary.Failures) / float64(summary.Runs)
+		if copies[summary] > 0 {
+			summary.AvgCopy = summary.CopyTime / float64(copies[summary])
+		}
+		if summary.CopyTime > 0 {
+			summary.Speed = float64(summary.Bytes) / summary.CopyTime
+		}
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Job != summaries[j].Job {
+			return summaries[i].Job < summaries[j].Job
+		}
+		return summaries[i].Site < summaries[j].Site
+	})
+	return summaries
+}
+
+func printSummary(out io.Writer, summaries []*historySummary) {
+	tw := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "JOB\tSITE\tRUNS\tFAILED\tRATE\tAVG COPY\tMAX COPY\tSPEED\tLAST\tEXIT")
+	for _, s := range summaries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%.1f%%\t%v\t%v\t%s/s\t%s\t%d\n", s.Job, s.Site, s.Runs, s.Failures, s.Rate*100,
+			time.Duration(s.AvgCopy*float64(time.Second)).Round(time.Second),
+			time.Duration(s.MaxCopy*float64(time.Second)).Round(time.Second),
+			humanize.Bytes(uint64(s.Speed)), s.Last.Format("2006-01-02 15:04"), s.LastExit)
+	}
+	tw.Flush()
+}
+
+// checknstart history [-file f] [-logdir d] [-job j] [-host h] [-since 7|2024-01-31] [-failed] [-last n] [-summary] [-json]
+func runHistoryCommand(args []string) int {
+	flags := flag.NewFlagSet(historyCommand, flag.ContinueOnError)
+	file := flags.String("file", "", "History file [checknstart-history.jsonl in -logdir]")
+	logdir := flags.String("logdir", "", "Log directory [current directory]")
+	job := flags.String("job", "", "Only this job")
+	host := flags.String("host", "", "Only this host or endpoint")
+	since := flags.String("since", "", "Only runs since n days, or since a date (yyyy-mm-dd)")
+	failed := flags.Bool("failed", false, "Only failed runs")
+	last := flags.Int("last", historylastdefval, "Number of runs listed (0: all)")
+	summary := flags.Bool("summary", false, "Summary per job and site: failure rate, copy times")
+	asjson := flags.Bool("json", false, "JSON output")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	filter := historyFilter{job: *job, host: *host, failed: *failed, last: *last}
+	var err error
+	if filter.since, err = parseSince(*since); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	path := *file
+	if path == "" {
+		dir := *logdir
+		if dir == "" {
+			dir = "."
+		}
+		path = filepath.Join(dir, fmt.Sprintf("%s-%s", logFileName, historyName))
+	}
+	runs, err := readHistory(path)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2 // File not found
+	}
+	var selected []runRecord
+	for _, run := range runs {
+		if filter.keep(run) {
+			selected = append(selected, run)
+		}
+	}
+	sort.SliceStable(selected, func(i, j int) bool { return selected[i].Start.Before(selected[j].Start) })
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if *summary {
+		summaries := summarize(selected)
+		if *asjson {
+			encoder.Encode(summaries)
+		} else {
+			printSummary(os.Stdout, summaries)
+		}
+		return 0
+	}
+	if filter.last > 0 && len(selected) > filter.last {
+		selected = selected[len(selected)-filter.last:]
+	}
+	if *asjson {
+		encoder.Encode(selected)
+	} else {
+		printRuns(os.Stdout, selected)
+	}
+	return 0
+}
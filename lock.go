@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// Verrou d'instance unique par tâche.
+// Un fichier <base>.lock local, et si -remotelock un fichier <distant>.lock sur
+// le partage, contenant PID / poste / battement de coeur. Deux sessions (VDI)
+// ne peuvent plus protéger et copier la même base en même temps.
+// -snapshot prend <base>.snapshot.lock au lieu du verrou de session. Copie en
+// début de session et sauvegardes (session ou snapshot) prennent à tour de rôle
+// <base>.backup.lock, en attendant que l'autre ait fini.
+
+const lockSuffix = ".lock"
+const snapshotLockSuffix = ".snapshot.lock"
+const backupLockSuffix = ".backup.lock"
+const lockWait = 1          // seconds between two attempts on a busy lock
+const lockHeartbeat = 30    // seconds between two heartbeats
+const lockstaledefval = 300 // seconds without heartbeat before a lock is stale
+
+// errLocked : lock held by a live instance
+var errLocked = errors.New("Job is locked")
+
+type (
+	// lockInfo : lock file content
+	lockInfo struct {
+		PID       int       `json:"pid"`
+		Host      string    `json:"host"`
+		User      string    `json:"user"`
+		Version   string    `json:"version"`
+		Started   time.Time `json:"started"`
+		Heartbeat time.Time `json:"heartbeat"`
+	}
+
+	// lockFile : a lock held by this instance
+	lockFile struct {
+		mu   sync.Mutex
+		path string
+		info lockInfo
+		stop chan struct{}
+		done chan struct{}
+	}
+)
+
+// Lock owner of this instance
+func ownLockInfo() lockInfo {
+	host, _ := os.Hostname()
+	user := os.Getenv("USERNAME")
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	now := time.Now()
+	return lockInfo{PID: os.Getpid(), Host: host, User: user, Version: VersionNum, Started: now, Heartbeat: now}
+}
+
+func (l lockInfo) String() string {
+	return fmt.Sprintf("pid %d on %s (%s) since %s, heartbeat %s",
+		l.PID, l.Host, l.User, l.Started.Format(time.RFC3339), l.Heartbeat.Format(time.RFC3339))
+}
+
+// Read a lock file
+func readLock(path string) (lockInfo, error) {
+	var info lockInfo
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+	return info, err
+}
+
+// Is the lock left by a dead instance?
+// Same host: owner process is gone. Otherwise: no heartbeat for stale seconds.
+func staleLock(info lockInfo, modtime time.Time, stale time.Duration) bool {
+	if host, _ := os.Hostname(); info.Host == host && info.PID > 0 && !processAlive(info.PID) {
+		return true
+	}
+	last := info.Heartbeat
+	if last.IsZero() {
+		// contenu illisible (écriture interrompue) : date du fichier
+		last = modtime
+	}
+	return time.Since(last) > stale
+}
+
+// Create the lock file, only if it does not exist
+func createLock(path string, info lockInfo) error {
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+	}
+	return err
+}
+
+// Same instance holds both locks
+func sameOwner(a, b lockInfo) bool {
+	return a.PID == b.PID && a.Host == b.Host && a.Started.Equal(b.Started)
+}
+
+// Move a stale lock away. Rename is atomic: one instance only gets the stale lock.
+// If the moved lock is no longer the stale one (renewed meanwhile), it is put back.
+func breakLock(path string, stale lockInfo) error {
+	moved := fmt.Sprintf("%s.%d.%d.stale", path, os.Getpid(), time.Now().UnixNano())
+	if err := os.Rename(path, moved); err != nil {
+		if os.IsNotExist(err) {
+			// déjà cassé par une autre instance
+			return nil
+		}
+		return fmt.Errorf("Unable to break stale lock %s: %v", path, err)
+	}
+	owner, err := readLock(moved)
+	if err == nil && (!sameOwner(owner, stale) || !owner.Heartbeat.Equal(stale.Heartbeat)) {
+		if rerr := os.Rename(moved, path); rerr != nil {
+			return fmt.Errorf("Unable to restore lock %s: %v", path, rerr)
+		}
+		return fmt.Errorf("%w by %s: %s", errLocked, path, owner)
+	}
+	os.Remove(moved)
+	return nil
+}
+
+// Take the lock on path, breaking it if stale
+func acquireLock(path string, stale time.Duration) (*lockFile, error) {
+	info := ownLockInfo()
+	for attempt := 0; attempt < 2; attempt++ {
+		err := createLock(path, info)
+		if err == nil {
+			// un autre poste a pu remettre son verrou par dessus le nôtre
+			if owner, rerr := readLock(path); rerr == nil && !sameOwner(owner, info) {
+				return nil, fmt.Errorf("%w by %s: %s", errLocked, path, owner)
+			}
+			lock := &lockFile{path: path, info: info, stop: make(chan struct{}), done: make(chan struct{})}
+			go lock.heartbeat()
+			return lock, nil
+		}
+		if !os.IsExist(err) {
+			return nil, fmt.Errorf("Unable to create lock %s: %v", path, err)
+		}
+		finfo, err := os.Stat(path)
+		if err != nil {
+			// verrou relâché entre temps
+			continue
+		}
+		owner, rerr := readLock(path)
+		if !staleLock(owner, finfo.ModTime(), stale) {
+			if rerr != nil {
+				return nil, fmt.Errorf("%w by %s (unreadable: %v)", errLocked, path, rerr)
+			}
+			return nil, fmt.Errorf("%w by %s: %s", errLocked, path, owner)
+		}
+		mylog.Warnf("Breaking stale lock %s: %s", path, owner)
+		if err := breakLock(path, owner); err != nil {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("Unable to take lock %s", path)
+}
+
+// Refresh heartbeat until release. Warn if somebody else took the lock.
+func (l *lockFile) heartbeat() {
+	defer close(l.done)
+	ticker := time.NewTicker(lockHeartbeat * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.stop:
+			return
+		case <-ticker.C:
+		}
+		if err := l.refresh(); err != nil {
+			mylog.WithError(err).Warnf("Lock %s heartbeat error", l.path)
+		}
+	}
+}
+
+// Write a new heartbeat, if the lock is still ours
+func (l *lockFile) refresh() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	owner, err := readLock(l.path)
+	if err != nil {
+		return err
+	}
+	if !sameOwner(owner, l.info) {
+		return fmt.Errorf("Lock taken over by %s", owner)
+	}
+	l.info.Heartbeat = time.Now()
+	data, err := json.Marshal(l.info)
+	if err != nil {
+		return err
+	}
+	// fichier temporaire puis renommage : le verrou n'est jamais vide ni tronqué
+	tmpname := fmt.Sprintf("%s.%d.tmp", l.path, l.info.PID)
+	if err := ioutil.WriteFile(tmpname, data, 0644); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	if err := os.Rename(tmpname, l.path); err != nil {
+		os.Remove(tmpname)
+		return err
+	}
+	return nil
+}
+
+// Stop heartbeat and remove the lock, if still ours
+func (l *lockFile) release() error {
+	close(l.stop)
+	<-l.done
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	owner, err := readLock(l.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if owner.PID != l.info.PID || owner.Host != l.info.Host {
+		return fmt.Errorf("Lock %s owned by %s, left in place", l.path, owner)
+	}
+	return os.Remove(l.path)
+}
+
+// Lock suffix: a snapshot runs beside the session, one snapshot at a time
+func jobLockSuffix(ctx *contextCache) string {
+	if *ctx.snapshot {
+		return snapshotLockSuffix
+	}
+	return lockSuffix
+}
+
+// Take local lock
+func lockLocal(ctx *contextCache) error {
+	return lockJob(ctx, *ctx.localname+jobLockSuffix(ctx))
+}
+
+// Take remote lock, on the share next to the remote database
+func lockRemote(ctx *contextCache) error {
+	if !*ctx.remotelock {
+		return nil
+	}
+	return lockJob(ctx, getRemotePath(ctx)+jobLockSuffix(ctx))
+}
+
+// Take the lock on path, waiting while a live instance holds it
+func waitLock(ctx *contextCache, path string) (*lockFile, error) {
+	stale := time.Duration(*ctx.lockstale) * time.Second
+	for attempt := 0; ; attempt++ {
+		lock, err := acquireLock(path, stale)
+		if err == nil || !errors.Is(err, errLocked) {
+			return lock, err
+		}
+		if attempt == 0 {
+			mylog.Printf("%v, waiting", err)
+		}
+		select {
+		case <-ctx.runctx.Done():
+			return nil, errCanceled
+		case <-time.After(lockWait * time.Second):
+		}
+	}
+}
+
+// Take the backup lock next to the local database. Returns its release.
+func lockBackup(ctx *contextCache) (func(), error) {
+	lock, err := waitLock(ctx, *ctx.localname+backupLockSuffix)
+	if err != nil {
+		return nil, err
+	}
+	ctx.locks = append(ctx.locks, lock)
+	return func() {
+		for i, held := range ctx.locks {
+			if held == lock {
+				ctx.locks = append(ctx.locks[:i], ctx.locks[i+1:]...)
+				break
+			}
+		}
+		if err := lock.release(); err != nil {
+			mylog.WithError(err).Warn("Unlock error")
+		}
+	}, nil
+}
+
+func lockJob(ctx *contextCache, path string) error {
+	lock, err := acquireLock(path, time.Duration(*ctx.lockstale)*time.Second)
+	if err != nil {
+		return err
+	}
+	ctx.locks = append(ctx.locks, lock)
+	if *ctx.verbose {
+		mylog.Printf("Lock %s taken", path)
+	}
+	return nil
+}
+
+// Release all locks, last taken first
+func unlockAll(ctx *contextCache) {
+	for i := len(ctx.locks) - 1; i >= 0; i-- {
+		if err := ctx.locks[i].release(); err != nil {
+			mylog.WithError(err).Warn("Unlock error")
+		}
+	}
+	ctx.locks = nil
+}
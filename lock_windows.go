@@ -0,0 +1,20 @@
+package main
+
+import "golang.org/x/sys/windows"
+
+const stillActive = 259 // STILL_ACTIVE exit code
+
+// Is process pid still running?
+func processAlive(pid int) bool {
+	handle, err := windows.OpenProcess(windows.PROCESS_QUERY_LIMITED_INFORMATION, false, uint32(pid))
+	if err != nil {
+		// accès refusé : le processus existe
+		return err == windows.ERROR_ACCESS_DENIED
+	}
+	defer windows.CloseHandle(handle)
+	var code uint32
+	if err := windows.GetExitCodeProcess(handle, &code); err != nil {
+		return true
+	}
+	return code == stillActive
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Journalisation : un seul logger (mylog), format texte / JSON / logfmt,
+// niveau et répertoire configurables. Chaque entrée porte les champs job et
+// stage ; les transferts utilisent file, bytes et duration.
+
+const logText = "text"
+const logJSON = "json"
+const logLogfmt = "logfmt"
+const logformatdefval = logText
+const logleveldefval = "info"
+
+// Common field names
+const fieldJob = "job"
+const fieldStage = "stage"
+const fieldFile = "file"
+const fieldBytes = "bytes"
+const fieldDuration = "duration"
+
+// Stages of a run
+const stageInit = "init"
+const stageCheck = "check"
+const stageCopy = "copy"
+const stageStart = "start"
+const stageWait = "wait"
+const stageBackup = "backup"
+const stageSpy = "spy"
+const stageShutdown = "shutdown"
+const stageRestore = "restore"
+
+// contextHook : add job and current stage to every entry
+type contextHook struct {
+	mu    sync.Mutex
+	job   string
+	stage string
+}
+
+var loghook = &contextHook{stage: stageInit}
+
+func (h *contextHook) Levels() []logrus.Level { return logrus.AllLevels }
+
+func (h *contextHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := entry.Data[fieldJob]; !ok {
+		entry.Data[fieldJob] = h.job
+	}
+	if _, ok := entry.Data[fieldStage]; !ok {
+		entry.Data[fieldStage] = h.stage
+	}
+	return nil
+}
+
+// Current stage, added to every log entry
+func setStage(stage string) {
+	loghook.mu.Lock()
+	defer loghook.mu.Unlock()
+	loghook.stage = stage
+	history.stage(stage)
+}
+
+// Current stage
+func currentStage() string {
+	loghook.mu.Lock()
+	defer loghook.mu.Unlock()
+	return loghook.stage
+}
+
+// textFormatter : human readable line, "time LEVEL [job/stage] message key=value ..."
+type textFormatter struct{}
+
+func (textFormatter) Format(entry *logrus.Entry) ([]byte, error) {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "%s %-5.5s [%v/%v] %s", entry.Time.Format("2006-01-02 15:04:05.000"),
+		strings.ToUpper(entry.Level.String()), entry.Data[fieldJob], entry.Data[fieldStage],
+		strings.TrimRight(entry.Message, "\n"))
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		if key != fieldJob && key != fieldStage {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		fmt.Fprintf(&b, " %s=%v", key, entry.Data[key])
+	}
+	b.WriteByte('\n')
+	return b.Bytes(), nil
+}
+
+// Formatter for -logformat
+func newLogFormatter(format string) (logrus.Formatter, error) {
+	switch format {
+	case logText:
+		return textFormatter{}, nil
+	case logJSON:
+		return &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano}, nil
+	case logLogfmt:
+		return &logrus.TextFormatter{DisableColors: true, FullTimestamp: true, TimestampFormat: time.RFC3339Nano, QuoteEmptyFields: true}, nil
+	}
+	return nil, fmt.Errorf("Unknown log format [%s] (%s|%s|%s)", format, logText, logJSON, logLogfmt)
+}
+
+// Log directory: -logdir, or current directory
+func logDir(ctx *contextCache) string {
+	if *ctx.logdir != "" {
+		return *ctx.logdir
+	}
+	return "."
+}
+
+// Level for -loglevel
+func logLevel(ctx *contextCache) (logrus.Level, error) {
+	level, err := logrus.ParseLevel(*ctx.loglevel)
+	if err != nil {
+		return level, fmt.Errorf("Unknown log level [%s] (debug|info|warn|error)", *ctx.loglevel)
+	}
+	// -verbose sans -loglevel : on garde le détail
+	if *ctx.verbose && level < logrus.DebugLevel && *ctx.loglevel == logleveldefval {
+		level = logrus.DebugLevel
+	}
+	return level, nil
+}
+
+// Configure mylog and open the log file of this run in -logdir
+func initLogging(ctx *contextCache, tag string) error {
+	formatter, err := newLogFormatter(*ctx.logformat)
+	if err != nil {
+		return err
+	}
+	level, err := logLevel(ctx)
+	if err != nil {
+		return err
+	}
+	dir := logDir(ctx)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Unable to create log directory %s: %v", dir, err)
+	}
+	maxsize, err := parseRate(*ctx.logmaxsize)
+	if err != nil {
+		return fmt.Errorf("Bad log size [%s]: %v", *ctx.logmaxsize, err)
+	}
+	file, err := newRotatingWriter(dir, fmt.Sprintf("%s-%s", logFileName, tag), int64(maxsize), time.Duration(*ctx.logmaxage)*time.Hour)
+	if err != nil {
+		return err
+	}
+	loghook.mu.Lock()
+	loghook.job = *ctx.job
+	loghook.mu.Unlock()
+	// masquage en premier : avant les champs et les destinations
+	mylog.AddHook(redactor)
+	mylog.AddHook(loghook)
+	mylog.SetFormatter(formatter)
+	mylog.SetLevel(level)
+	mylog.SetOutput(file)
+	ctx.logfile = file
+	return initSinks(ctx)
+}
+
+// Close the log file
+func closeLogging(ctx *contextCache) {
+	closeSinks()
+	if ctx.logfile == nil {
+		return
+	}
+	mylog.SetOutput(os.Stderr)
+	ctx.logfile.Close()
+	ctx.logfile = nil
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Rotation et rétention des journaux.
+// Rotation : un nouveau segment checknstart-<tag>.<n>.log quand le segment en
+// cours dépasse -logmaxsize ou -logmaxage. Rétention (cleanLogs) : du plus
+// récent au plus ancien, on garde -logkeep fichiers, de moins de -logdays jours,
+// dans la limite de -logmaxtotal octets. -loggzip compresse les anciens journaux.
+// Les journaux d'une autre instance ne sont touchés qu'une fois inactifs depuis
+// -logmaxage (24h si pas de limite) : ils peuvent être encore ouverts.
+
+const logkeepdefval = cleanlog
+const logdaysdefval = 30
+const logmaxtotaldefval = "100mb"
+const logmaxsizedefval = "10mb"
+const logmaxagedefval = 24 // hours
+const logGzipSuffix = ".gz"
+
+// rotatingWriter : log file, switching to a new segment on size or age
+type rotatingWriter struct {
+	mu      sync.Mutex
+	dir     string
+	base    string
+	maxsize int64
+	maxage  time.Duration
+	segment int
+	file    *os.File
+	size    int64
+	opened  time.Time
+}
+
+// Open the first segment
+func newRotatingWriter(dir, base string, maxsize int64, maxage time.Duration) (*rotatingWriter, error) {
+	w := &rotatingWriter{dir: dir, base: base, maxsize: maxsize, maxage: maxage}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Segment file name: base.log, then base.1.log, base.2.log...
+func (w *rotatingWriter) name() string {
+	if w.segment == 0 {
+		return filepath.Join(w.dir, fmt.Sprintf("%s.log", w.base))
+	}
+	return filepath.Join(w.dir, fmt.Sprintf("%s.%d.log", w.base, w.segment))
+}
+
+func (w *rotatingWriter) open() error {
+	name := w.name()
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("Unable to open log file %s: %v", name, err)
+	}
+	finfo, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	w.file = file
+	w.size = finfo.Size()
+	w.opened = time.Now()
+	return nil
+}
+
+// Write, rotating first if needed. A failed rotation keeps the current segment.
+func (w *rotatingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.size > 0 && ((w.maxsize > 0 && w.size+int64(len(p)) > w.maxsize) ||
+		(w.maxage > 0 && time.Since(w.opened) > w.maxage)) {
+		previous := w.file
+		w.segment++
+		if err := w.open(); err != nil {
+			w.segment--
+			w.file = previous
+		} else {
+			previous.Close()
+		}
+	}
+	n, err := w.file.Write(p)
+	w.size += int64(n)
+	return n, err
+}
+
+// Current segment path
+func (w *rotatingWriter) Path() string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Name()
+}
+
+func (w *rotatingWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.file.Close()
+}
+
+// Log files of the log directory, newest first
+func listLogs(dir string) ([]os.FileInfo, error) {
+	var logs []os.FileInfo
+	for _, pattern := range []string{"%s-*.log", "%s-*.log" + logGzipSuffix} {
+		files, err := getFiles(filepath.Join(dir, fmt.Sprintf(pattern, logFileName)))
+		if err != nil {
+			return nil, err
+		}
+		logs = append(logs, files...)
+	}
+	sort.Slice(logs, func(i, j int) bool {
+		if logs[i].ModTime().Equal(logs[j].ModTime()) {
+			return logs[i].Name() > logs[j].Name()
+		}
+		return logs[i].ModTime().After(logs[j].ModTime())
+	})
+	return logs, nil
+}
+
+// Gzip an old log file, keeping its modification time
+func gzipLog(path string) (os.FileInfo, error) {
+	if _, _, err := compressFile(compressGzip, path); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path, path+logGzipSuffix); err != nil {
+		return nil, err
+	}
+	return os.Stat(path + logGzipSuffix)
+}
+
+// Log file of another instance, written less than the rotation age ago: maybe still open
+func logInUse(ctx *contextCache, file os.FileInfo, own string) bool {
+	if strings.HasPrefix(file.Name(), own+".") {
+		// segment fermé de cette instance
+		return false
+	}
+	idle := time.Duration(*ctx.logmaxage) * time.Hour
+	if idle <= 0 {
+		idle = logmaxagedefval * time.Hour
+	}
+	return time.Since(file.ModTime()) < idle
+}
+
+// On va faire du ménage dans les logs détaillés
+func cleanLogs(ctx *contextCache) {
+	dir := logDir(ctx)
+	own := fmt.Sprintf("%s-%s", logFileName, ctx.tag)
+	current := ""
+	if ctx.logfile != nil {
+		current = filepath.Base(ctx.logfile.Path())
+	}
+	maxtotal, err := parseRate(*ctx.logmaxtotal)
+	if err != nil {
+		mylog.Warnf("cleanlogs error ! Bad -logmaxtotal %s: %v", *ctx.logmaxtotal, err)
+		return
+	}
+	files, err := listLogs(dir)
+	if err != nil {
+		mylog.Warn("cleanlogs error ! Unable to get log files info.")
+		return
+	}
+	var total uint64
+	var removed int
+	for idx, file := range files {
+		path := filepath.Join(dir, file.Name())
+		if file.Name() == current || logInUse(ctx, file, own) {
+			total += uint64(file.Size())
+			continue
+		}
+		keep := idx < *ctx.logkeep
+		if keep && *ctx.logdays > 0 && time.Since(file.ModTime()) > time.Duration(*ctx.logdays)*24*time.Hour {
+			keep = false
+		}
+		if keep && *ctx.loggzip && !strings.HasSuffix(file.Name(), logGzipSuffix) {
+			if finfo, err := gzipLog(path); err != nil {
+				mylog.Warnf("cleanlogs error ! Unable to gzip %s: %v", path, err)
+			} else {
+				file = finfo
+				path += logGzipSuffix
+			}
+		}
+		if keep && maxtotal > 0 && total+uint64(file.Size()) > maxtotal {
+			keep = false
+		}
+		if keep {
+			total += uint64(file.Size())
+			continue
+		}
+		if *ctx.verbose {
+			mylog.Printf("Cleaning log (%d) %s", idx, path)
+		}
+		if err := os.Remove(path); err != nil {
+			mylog.Warnf("cleanlogs error ! Unable to remove %s: %v", path, err)
+			continue
+		}
+		removed++
+	}
+	if *ctx.verbose {
+		mylog.Printf("Cleaning %d on %d files, %s kept.", removed, len(files), humanize.Bytes(total))
+	}
+}
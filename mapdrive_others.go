@@ -0,0 +1,11 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "fmt"
+
+// Map UNC ressource address: Windows only
+func mapDrive(address string, user string, pw string, verbose bool) error {
+	return fmt.Errorf("Unable to map %s: share mapping is only done on Windows", address)
+}
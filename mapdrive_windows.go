@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"unsafe"
+
+	"golang.org/x/sys/windows"
+)
+
+// Connexion au partage par l'API WNet : le mot de passe ne passe plus par la
+// ligne de commande de net.exe
+
+const resourceTypeDisk = 1 // RESOURCETYPE_DISK
+
+var (
+	mpr                        = windows.NewLazySystemDLL("mpr.dll")
+	procWNetAddConnection2W    = mpr.NewProc("WNetAddConnection2W")
+	procWNetCancelConnection2W = mpr.NewProc("WNetCancelConnection2W")
+)
+
+// netResource : NETRESOURCEW
+type netResource struct {
+	Scope       uint32
+	Type        uint32
+	DisplayType uint32
+	Usage       uint32
+	LocalName   *uint16
+	RemoteName  *uint16
+	Comment     *uint16
+	Provider    *uint16
+}
+
+// Map UNC ressource address with user account
+func mapDrive(address string, user string, pw string, verbose bool) error {
+	remote, err := windows.UTF16PtrFromString(address)
+	if err != nil {
+		return err
+	}
+	username, err := windows.UTF16PtrFromString(user)
+	if err != nil {
+		return err
+	}
+	password, err := windows.UTF16PtrFromString(pw)
+	if err != nil {
+		return err
+	}
+	procWNetCancelConnection2W.Call(uintptr(unsafe.Pointer(remote)), 0, 1)
+	if verbose {
+		mylog.Println("map", address, fmt.Sprintf("/user:%s", user))
+	}
+	resource := netResource{Type: resourceTypeDisk, RemoteName: remote}
+	ret, _, _ := procWNetAddConnection2W.Call(uintptr(unsafe.Pointer(&resource)),
+		uintptr(unsafe.Pointer(password)), uintptr(unsafe.Pointer(username)), 0)
+	if ret != 0 {
+		return fmt.Errorf("%s: %v", address, windows.Errno(ret))
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Règles de comparaison des valeurs lues par les signaux (registre, contenu de
+// fichier, variable d'environnement, message socket).
+// Syntaxe de -match :
+//   date                 valeur = date du jour au format 02/01/2006 (défaut)
+//   date:2006-01-02      valeur = date du jour au format Go donné
+//   changed              valeur différente de celle lue au démarrage
+//   gt:20170911          valeur supérieure (numérique si possible, sinon texte)
+//   eq:DONE              valeur égale
+//   regex:^OK-[0-9]+$    valeur conforme à l'expression régulière
+//   any                  valeur présente et non vide
+
+const matchDate = "date"
+const matchChanged = "changed"
+const matchGreater = "gt"
+const matchEqual = "eq"
+const matchRegex = "regex"
+const matchAny = "any"
+
+// matchRule : how a signal value is compared
+type matchRule struct {
+	kind       string
+	arg        string
+	re         *regexp.Regexp
+	mu         sync.Mutex
+	seen       bool
+	first      string
+	firstfound bool
+}
+
+// Parse -match rule. Empty rule gives defrule.
+func newMatchRule(spec string, defrule string) (*matchRule, error) {
+	if spec == "" {
+		spec = defrule
+	}
+	kind, arg := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		kind, arg = spec[:idx], spec[idx+1:]
+	}
+	rule := &matchRule{kind: kind, arg: arg}
+	switch kind {
+	case matchDate:
+		if rule.arg == "" {
+			rule.arg = dateLayout
+		}
+	case matchChanged, matchAny:
+	case matchGreater, matchEqual:
+		if arg == "" {
+			return nil, fmt.Errorf("Match rule [%s] needs a value (%s:value)", spec, kind)
+		}
+	case matchRegex:
+		re, err := regexp.Compile(arg)
+		if err != nil {
+			return nil, fmt.Errorf("Bad match regex [%s]: %v", arg, err)
+		}
+		rule.re = re
+	default:
+		return nil, fmt.Errorf("Unknown match rule [%s] (%s|%s|%s|%s|%s|%s)", kind,
+			matchDate, matchChanged, matchGreater, matchEqual, matchRegex, matchAny)
+	}
+	return rule, nil
+}
+
+// Compare values, numerically if both are numbers
+func compareValues(a, b string) int {
+	fa, erra := strconv.ParseFloat(a, 64)
+	fb, errb := strconv.ParseFloat(b, 64)
+	if erra == nil && errb == nil {
+		switch {
+		case fa < fb:
+			return -1
+		case fa > fb:
+			return 1
+		}
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+// Check a value read by a signal. found is false if the value does not exist (yet).
+func (rule *matchRule) match(value string, found bool) bool {
+	value = strings.TrimSpace(value)
+	if rule.kind == matchChanged {
+		rule.mu.Lock()
+		defer rule.mu.Unlock()
+		if !rule.seen {
+			rule.seen = true
+			rule.first = value
+			rule.firstfound = found
+			return false
+		}
+		return found != rule.firstfound || value != rule.first
+	}
+	if !found {
+		return false
+	}
+	switch rule.kind {
+	case matchDate:
+		return value == time.Now().Local().Format(rule.arg)
+	case matchGreater:
+		return compareValues(value, rule.arg) > 0
+	case matchEqual:
+		return value == rule.arg
+	case matchRegex:
+		return rule.re.MatchString(value)
+	case matchAny:
+		return value != ""
+	}
+	return false
+}
+
+func (rule *matchRule) String() string {
+	if rule.arg == "" {
+		return rule.kind
+	}
+	return fmt.Sprintf("%s:%s", rule.kind, rule.arg)
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Métriques Prometheus (format texte 0.0.4), servies sur -metrics host:port
+// pendant toute l'exécution : octets transférés, durées de copie et de
+// sauvegarde, sondes SMB, démarrages du programme externe, étape en cours.
+
+const metricsPath = "/metrics"
+const metricsPrefix = "checknstart_"
+
+// Buckets (seconds) for copy and backup durations
+var durationBuckets = []float64{1, 5, 15, 30, 60, 120, 300, 600, 1800, 3600}
+
+// All stages, exported at 0 or 1
+var allStages = []string{stageInit, stageRestore, stageCheck, stageCopy, stageStart, stageWait, stageBackup, stageSpy, stageShutdown}
+
+type (
+	// histogram : cumulative buckets, sum and count
+	histogram struct {
+		counts []uint64
+		sum    float64
+		count  uint64
+	}
+
+	// probeStatus : last endpoint probe
+	probeStatus struct {
+		At      time.Time `json:"at"`
+		Success bool      `json:"success"`
+		Error   string    `json:"error,omitempty"`
+	}
+
+	// copyStatus : last copy with the endpoint
+	copyStatus struct {
+		At        time.Time `json:"at"`
+		Direction string    `json:"direction"`
+		Bytes     int64     `json:"bytes"`
+		Duration  float64   `json:"duration"`
+	}
+
+	// metricsRegistry : values exported on /metrics
+	metricsRegistry struct {
+		mu        sync.Mutex
+		started   time.Time
+		bytes     map[string]float64
+		copies    map[string]*histogram
+		backups   *histogram
+		probes    map[string]float64
+		child     *supervisor
+		lastprobe *probeStatus
+		lastcopy  *copyStatus
+		server    *http.Server
+	}
+)
+
+// Metrics of this run, collected from start, served once initMetrics is called
+var metrics = &metricsRegistry{
+	started: time.Now(),
+	bytes:   make(map[string]float64),
+	copies:  make(map[string]*histogram),
+	backups: newHistogram(),
+	probes:  make(map[string]float64),
+}
+
+func newHistogram() *histogram {
+	return &histogram{counts: make([]uint64, len(durationBuckets))}
+}
+
+func (h *histogram) observe(value float64) {
+	for i, bound := range durationBuckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.sum += value
+	h.count++
+}
+
+// Bytes copied in direction (get|put) and copy duration
+func (m *metricsRegistry) transfer(direction string, bytes int64, elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.bytes[direction] += float64(bytes)
+	if m.copies[direction] == nil {
+		m.copies[direction] = newHistogram()
+	}
+	m.copies[direction].observe(elapsed.Seconds())
+	m.lastcopy = &copyStatus{At: time.Now(), Direction: direction, Bytes: bytes, Duration: elapsed.Seconds()}
+}
+
+// Duration of a database backup (dump only, copy excluded)
+func (m *metricsRegistry) backup(elapsed time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.backups.observe(elapsed.Seconds())
+}
+
+// Endpoint connectivity probe result
+func (m *metricsRegistry) probe(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.lastprobe = &probeStatus{At: time.Now(), Success: err == nil}
+	if err != nil {
+		m.lastprobe.Error = err.Error()
+		m.probes["failure"]++
+	} else {
+		m.probes["success"]++
+	}
+}
+
+// Supervised child, nil before start
+func (m *metricsRegistry) supervised() *supervisor {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.child
+}
+
+// Last probe and last copy, nil if none yet
+func (m *metricsRegistry) last() (*probeStatus, *copyStatus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lastprobe, m.lastcopy
+}
+
+// Supervised child, for start and state metrics
+func (m *metricsRegistry) watch(child *supervisor) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.child = child
+}
+
+// Escape a label value
+func labelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+func writeHeader(w io.Writer, name, kind, help string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsPrefix, name, help, metricsPrefix, name, kind)
+}
+
+func writeHistogram(w io.Writer, name, labels string, h *histogram) {
+	sep := ""
+	if labels != "" {
+		sep = ","
+	}
+	for i, bound := range durationBuckets {
+		fmt.Fprintf(w, "%s%s_bucket{%s%sle=\"%g\"} %d\n", metricsPrefix, name, labels, sep, bound, h.counts[i])
+	}
+	fmt.Fprintf(w, "%s%s_bucket{%s%sle=\"+Inf\"} %d\n", metricsPrefix, name, labels, sep, h.count)
+	if labels != "" {
+		labels = "{" + labels + "}"
+	}
+	fmt.Fprintf(w, "%s%s_sum%s %g\n", metricsPrefix, name, labels, h.sum)
+	fmt.Fprintf(w, "%s%s_count%s %d\n", metricsPrefix, name, labels, h.count)
+}
+
+// Write all metrics, Prometheus text format. Formatted in memory under the lock,
+// sent after: a slow scraper never blocks the copy and spy paths.
+func (m *metricsRegistry) write(out io.Writer, ctx *contextCache) {
+	var w bytes.Buffer
+	m.render(&w, ctx)
+	out.Write(w.Bytes())
+}
+
+func (m *metricsRegistry) render(w io.Writer, ctx *contextCache) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	host, _ := os.Hostname()
+	writeHeader(w, "info", "gauge", "Version, job and host of this instance.")
+	fmt.Fprintf(w, "%sinfo{version=\"%s\",job=\"%s\",host=\"%s\",endpoint=\"%s\"} 1\n", metricsPrefix,
+		labelValue(VersionNum), labelValue(*ctx.job), labelValue(host), labelValue(*ctx.endpoint))
+	writeHeader(w, "start_time_seconds", "gauge", "Start time of this run, unix seconds.")
+	fmt.Fprintf(w, "%sstart_time_seconds %d\n", metricsPrefix, m.started.Unix())
+
+	writeHeader(w, "stage", "gauge", "Current stage of the run (1 for the current one).")
+	current := currentStage()
+	for _, stage := range allStages {
+		value := 0
+		if stage == current {
+			value = 1
+		}
+		fmt.Fprintf(w, "%sstage{stage=\"%s\"} %d\n", metricsPrefix, stage, value)
+	}
+
+	writeHeader(w, "bytes_transferred_total", "counter", "Bytes copied from (get) or to (put) the endpoint.")
+	for _, direction := range []string{"get", "put"} {
+		fmt.Fprintf(w, "%sbytes_transferred_total{direction=\"%s\"} %g\n", metricsPrefix, direction, m.bytes[direction])
+	}
+	writeHeader(w, "copy_duration_seconds", "histogram", "Duration of file copies with the endpoint.")
+	for _, direction := range []string{"get", "put"} {
+		h := m.copies[direction]
+		if h == nil {
+			h = newHistogram()
+		}
+		writeHistogram(w, "copy_duration_seconds", fmt.Sprintf("direction=\"%s\"", direction), h)
+	}
+	writeHeader(w, "backup_duration_seconds", "histogram", "Duration of database backups.")
+	writeHistogram(w, "backup_duration_seconds", "", m.backups)
+
+	writeHeader(w, "probe_total", "counter", "Endpoint SMB connectivity probes, by result.")
+	for _, result := range []string{"success", "failure"} {
+		fmt.Fprintf(w, "%sprobe_total{result=\"%s\"} %g\n", metricsPrefix, result, m.probes[result])
+	}
+
+	starts, up := 0, 0
+	if m.child != nil {
+		starts = m.child.Starts()
+		if m.child.State() == stateRunning {
+			up = 1
+		}
+	}
+	restarts := 0
+	if starts > 1 {
+		restarts = starts - 1
+	}
+	writeHeader(w, "child_starts_total", "counter", "Starts of the external program.")
+	fmt.Fprintf(w, "%schild_starts_total %d\n", metricsPrefix, starts)
+	writeHeader(w, "child_restarts_total", "counter", "Restarts of the external program.")
+	fmt.Fprintf(w, "%schild_restarts_total %d\n", metricsPrefix, restarts)
+	writeHeader(w, "child_up", "gauge", "External program running (1) or not (0).")
+	fmt.Fprintf(w, "%schild_up %d\n", metricsPrefix, up)
+}
+
+// Start the metrics listener on -metrics. A listener error is logged, not fatal.
+func initMetrics(ctx *contextCache) error {
+	if *ctx.metrics == "" {
+		return nil
+	}
+	listener, err := net.Listen("tcp", *ctx.metrics)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for metrics on %s: %v", *ctx.metrics, err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(metricsPath, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		metrics.write(w, ctx)
+	})
+	metrics.mu.Lock()
+	metrics.server = &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	server := metrics.server
+	metrics.mu.Unlock()
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			mylog.WithError(err).Error("Metrics listener error")
+		}
+	}()
+	mylog.Printf("Metrics on http://%s%s", listener.Addr(), metricsPath)
+	return nil
+}
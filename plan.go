@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"time"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Mode -dry-run : seuls les contrôles en lecture sont faits (fichier distant,
+// dates, choix des emplacements de version, signal), puis le plan des actions
+// (renommages, suppressions, copies, sauvegarde) est affiché. Rien n'est modifié.
+
+// runPlan : planned actions of a run
+type runPlan struct {
+	steps  []string
+	indent string
+}
+
+// Add a planned action, shown on stdout and logged
+func (p *runPlan) add(format string, args ...interface{}) {
+	step := p.indent + fmt.Sprintf(format, args...)
+	p.steps = append(p.steps, step)
+	fmt.Printf("%2d. %s\n", len(p.steps), step)
+	mylog.Printf("dry-run %d: %s", len(p.steps), step)
+}
+
+// Plan protection of path (rename to a version slot). Returns the slot.
+func (p *runPlan) protect(ctx *contextCache, path string, codec string, encrypt bool, taken ...int) (int, error) {
+	if here, _, err := exists(path); err != nil {
+		return -1, err
+	} else if !here {
+		p.add("WARNING %s does not exist, its protection will fail", path)
+	}
+	slot, reuse, err := pickVersionSlot(path, *ctx.verbose, taken...)
+	if err != nil {
+		return -1, err
+	}
+	version := fmt.Sprintf("%s.%d", path, slot)
+	if reuse {
+		if slot < 0 {
+			p.add("WARNING no version slot can be reused for %s (dates in the future), protection will fail", path)
+			return slot, nil
+		}
+		_, modtime, _ := exists(version)
+		p.add("DELETE %s (oldest of %d versions, %s)", version, maxversion, modtime.Format(time.RFC3339))
+	}
+	p.add("RENAME %s -> %s", path, version)
+	if codec != compressNone {
+		p.add("COMPRESS %s (%s)", version, codec)
+	}
+	if encrypt {
+		p.add("ENCRYPT %s (%s)", version, encryptName)
+	}
+	return slot, nil
+}
+
+// Describe a file to copy
+func describeFile(finfo os.FileInfo) string {
+	return fmt.Sprintf("%s, modified %s", humanize.Bytes(uint64(finfo.Size())), finfo.ModTime().Format(time.RFC3339))
+}
+
+// Run read-only checks and print what a run would do. Returns exit code.
+func dryRun(ctx *contextCache) int {
+	ctx.runctx = context.Background()
+	p := &runPlan{}
+	fmt.Println("DRY RUN - nothing will be renamed, copied, deleted or started")
+	mylog.Println("Dry run: read-only checks")
+
+	if err := remoteFileHere(ctx); err != nil {
+		p.add("STOP remote file unavailable: %v", err)
+		return 2 // File not found
+	}
+	remote := getRemotePath(ctx)
+	if *ctx.snapshot {
+		p.add("BACKUP with %s provider (%s) in a work directory of %s", ctx.provider.Name(), ctx.provider.Tool(ctx), workdirBase(ctx))
+		if _, err := p.protect(ctx, remote, compressNone, false); err != nil {
+			p.add("STOP %v", err)
+			return 3 // Copy error
+		}
+		p.add("COPY put backup -> %s (rate %s)", remote, ctx.limitput)
+		fmt.Printf("%d planned step(s). Run without -dry-run to apply.\n", len(p.steps))
+		return 0
+	}
+	docopy, err := compareFileAge(ctx)
+	if err != nil {
+		p.add("STOP local file unavailable: %v", err)
+		return 2 // File not found
+	}
+
+	var remoteslot []int
+	if docopy {
+		p.add("Remote %s (%s) is newer than local %s (%s)", remote, describeFile(ctx.remoteinfo), *ctx.localname, describeFile(ctx.localinfo))
+		if _, err := p.protect(ctx, *ctx.localname, *ctx.compress, *ctx.encrypt); err != nil {
+			p.add("STOP %v", err)
+			return 3 // Copy error
+		}
+		if err := checkLocalSpace(ctx); err != nil {
+			p.add("WARNING %v, copy will stop", err)
+		}
+		p.add("COPY get %s -> %s (%s, rate %s)", remote, *ctx.localname, humanize.Bytes(uint64(ctx.remoteinfo.Size())), ctx.limitget)
+		empty, err := getFileSpec(*ctx.localempty, "empty", *ctx.verbose)
+		if err != nil {
+			p.add("WARNING empty database unavailable, remote file will not be emptied: %v", err)
+		} else {
+			slot, err := p.protect(ctx, remote, compressNone, false)
+			if err != nil {
+				p.add("STOP %v", err)
+				return 3 // Copy error
+			}
+			remoteslot = append(remoteslot, slot)
+			p.add("COPY put %s -> %s (%s, rate %s)", *ctx.localempty, remote, describeFile(empty), ctx.limitput)
+		}
+	} else {
+		p.add("No copy needed: local %s (%s) is up to date versus %s (%s)", *ctx.localname, describeFile(ctx.localinfo), remote, describeFile(ctx.remoteinfo))
+	}
+
+	if path, err := exec.LookPath(*ctx.cmd); err != nil {
+		p.add("WARNING %s not found, it will not start: %v", *ctx.cmd, err)
+	} else {
+		p.add("START %s", path)
+	}
+
+	ready, err := sqlUpdated(ctx)
+	state := "off"
+	if err != nil {
+		state = fmt.Sprintf("unreadable: %v", err)
+	} else if ready {
+		state = "on"
+	}
+	p.add("WAIT for %s (now %s) at most %d second(s)", ctx.signal, state, *ctx.howlong)
+	switch {
+	case ready && *ctx.tocancel:
+		p.add("Signal already on and -timeoutko: no backup")
+	case *ctx.tocancel:
+		p.add("On signal only (timeout cancels):")
+	default:
+		p.add("On signal or timeout:")
+	}
+	if !(ready && *ctx.tocancel) {
+		p.indent = "  "
+		tool := ctx.provider.Tool(ctx)
+		if path, err := exec.LookPath(tool); err != nil {
+			p.add("WARNING backup tool %s not found: %v", tool, err)
+		} else {
+			p.add("BACKUP with %s provider (%s) in a work directory of %s", ctx.provider.Name(), path, workdirBase(ctx))
+		}
+		if size, name, found := previousVersionSize(ctx); found {
+			p.add("VALIDATE backup size between %.2f and %.2f x %s (%s)", *ctx.sizemin, *ctx.sizemax, humanize.Bytes(uint64(size)), name)
+		}
+		if *ctx.validcmd != "" {
+			p.add("VALIDATE with %s %s", *ctx.validcmd, *ctx.validarg)
+		}
+		if _, err := p.protect(ctx, remote, compressNone, false, remoteslot...); err != nil {
+			p.add("STOP %v", err)
+			return 3 // Copy error
+		}
+		p.add("COPY put backup -> %s (rate %s)", remote, ctx.limitput)
+		p.indent = ""
+	}
+	if *ctx.endpoint != "" {
+		p.add("SPY %s every %d second(s), stop %s if unreachable", net.JoinHostPort(*ctx.endpoint, strconv.Itoa(portCheck)), spyLoop, *ctx.cmd)
+	}
+	fmt.Printf("%d planned step(s). Run without -dry-run to apply.\n", len(p.steps))
+	return 0
+}
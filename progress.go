@@ -0,0 +1,249 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/term"
+)
+
+// Suivi de progression des copies : barre de progression console, événements
+// de log périodiques, et interface progressListener pour d'autres frontaux.
+
+const progressAuto = "auto"
+const progressBar = "bar"
+const progressLog = "log"
+const progressNone = "none"
+const progressLoop = 1     // seconds between two progress events
+const progressLogLoop = 30 // seconds between two progress log events
+const progressBarWidth = 30
+
+type (
+	// progressInfo : state of one transfer
+	progressInfo struct {
+		name    string
+		done    int64
+		total   int64
+		rate    float64 // bytes per second, smoothed
+		elapsed time.Duration
+		eta     time.Duration
+	}
+
+	// progressListener : receive progress events of every transfer
+	progressListener interface {
+		Progress(p progressInfo)
+		Finished(p progressInfo, err error)
+	}
+
+	// progressReader : count bytes read and notify listeners
+	progressReader struct {
+		r     io.Reader
+		done  int64
+		total int64
+		name  string
+		start time.Time
+		stop  chan struct{}
+		once  sync.Once
+	}
+
+	// barListener : terminal progress bar
+	barListener struct {
+		out   io.Writer
+		width int
+	}
+
+	// logListener : periodic structured log events
+	logListener struct {
+		mu   sync.Mutex
+		last time.Time
+	}
+)
+
+var progressMu sync.Mutex
+var progressListeners []progressListener
+
+// Register a listener for every transfer
+func addProgressListener(l progressListener) {
+	progressMu.Lock()
+	defer progressMu.Unlock()
+	progressListeners = append(progressListeners, l)
+}
+
+// Is out a terminal?
+func isTerminal(out io.Writer) bool {
+	file, ok := out.(*os.File)
+	return ok && term.IsTerminal(int(file.Fd()))
+}
+
+// Set up default listeners from -progress mode
+func initProgress(mode string, out io.Writer) error {
+	switch mode {
+	case progressAuto:
+		// barre seulement sur un terminal (pas de \r dans une sortie redirigée)
+		if isTerminal(out) {
+			addProgressListener(&barListener{out: out, width: progressBarWidth})
+		}
+		addProgressListener(&logListener{})
+	case progressBar:
+		addProgressListener(&barListener{out: out, width: progressBarWidth})
+	case progressLog:
+		addProgressListener(&logListener{})
+	case progressNone:
+	default:
+		return fmt.Errorf("Unknown progress mode [%s] (auto|bar|log|none)", mode)
+	}
+	return nil
+}
+
+func notifyProgress(p progressInfo, finished bool, err error) {
+	progressMu.Lock()
+	listeners := progressListeners
+	progressMu.Unlock()
+	for _, l := range listeners {
+		if finished {
+			l.Finished(p, err)
+			continue
+		}
+		l.Progress(p)
+	}
+}
+
+// Wrap a reader to follow a transfer of total bytes
+func newProgressReader(r io.Reader, name string, total int64) *progressReader {
+	pr := &progressReader{r: r, total: total, name: name, start: time.Now(), stop: make(chan struct{})}
+	go pr.loop()
+	return pr
+}
+
+func (pr *progressReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	atomic.AddInt64(&pr.done, int64(n))
+	return n, err
+}
+
+// Compute rate (exponential moving average) and ETA every progressLoop
+func (pr *progressReader) loop() {
+	ticker := time.NewTicker(progressLoop * time.Second)
+	defer ticker.Stop()
+	var last int64
+	var rate float64
+	for {
+		select {
+		case <-pr.stop:
+			return
+		case <-ticker.C:
+		}
+		done := atomic.LoadInt64(&pr.done)
+		instant := float64(done-last) / progressLoop
+		last = done
+		if rate == 0 {
+			rate = instant
+		} else {
+			rate = 0.7*rate + 0.3*instant
+		}
+		notifyProgress(pr.info(rate), false, nil)
+	}
+}
+
+func (pr *progressReader) info(rate float64) progressInfo {
+	p := progressInfo{
+		name:    pr.name,
+		done:    atomic.LoadInt64(&pr.done),
+		total:   pr.total,
+		rate:    rate,
+		elapsed: time.Since(pr.start),
+	}
+	if rate > 0 && p.total > p.done {
+		p.eta = time.Duration(float64(p.total-p.done)/rate) * time.Second
+	}
+	return p
+}
+
+// End of transfer, with its error if any
+func (pr *progressReader) finish(err error) {
+	pr.once.Do(func() {
+		close(pr.stop)
+		elapsed := time.Since(pr.start).Seconds()
+		if elapsed <= 0 {
+			elapsed = 1
+		}
+		notifyProgress(pr.info(float64(atomic.LoadInt64(&pr.done))/elapsed), true, err)
+	})
+}
+
+// Percentage done
+func (p progressInfo) percent() float64 {
+	if p.total <= 0 {
+		return 0
+	}
+	return float64(p.done) * 100 / float64(p.total)
+}
+
+func (b *barListener) render(p progressInfo, eol string) {
+	filled := int(p.percent() * float64(b.width) / 100)
+	if filled > b.width {
+		filled = b.width
+	}
+	bar := strings.Repeat("=", filled)
+	if filled < b.width {
+		bar += ">" + strings.Repeat(" ", b.width-filled-1)
+	}
+	fmt.Fprintf(b.out, "\r[%s] %5.1f%% %s/%s %s/s ETA %s   %s",
+		bar, p.percent(),
+		humanize.Bytes(uint64(p.done)), humanize.Bytes(uint64(p.total)),
+		humanize.Bytes(uint64(p.rate)), p.eta.Round(time.Second), eol)
+}
+
+// Progress : redraw the bar on the same line
+func (b *barListener) Progress(p progressInfo) {
+	b.render(p, "")
+}
+
+// Finished : last bar, then new line
+func (b *barListener) Finished(p progressInfo, err error) {
+	if err != nil {
+		fmt.Fprintf(b.out, "\n%s: %v\n", p.name, err)
+		return
+	}
+	b.render(p, "\n")
+}
+
+func progressFields(p progressInfo) logrus.Fields {
+	return logrus.Fields{
+		fieldFile:     p.name,
+		fieldBytes:    p.done,
+		fieldDuration: p.elapsed.Seconds(),
+		"total":       p.total,
+		"percent":     fmt.Sprintf("%.1f", p.percent()),
+		"rate":        humanize.Bytes(uint64(p.rate)),
+		"eta":         fmt.Sprintf("%v", p.eta.Round(time.Second)),
+		"sizeHuman":   humanize.Bytes(uint64(p.total)),
+	}
+}
+
+// Progress : log at most every progressLogLoop seconds
+func (l *logListener) Progress(p progressInfo) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if time.Since(l.last) < progressLogLoop*time.Second {
+		return
+	}
+	l.last = time.Now()
+	mylog.WithFields(progressFields(p)).Info("transfer progress")
+}
+
+// Finished : always logged
+func (l *logListener) Finished(p progressInfo, err error) {
+	if err != nil {
+		mylog.WithFields(progressFields(p)).WithError(err).Warn("transfer failed")
+		return
+	}
+	mylog.WithFields(progressFields(p)).Info("transfer done")
+}
@@ -0,0 +1,289 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sources du signal "prêt" attendu par waitandlaunch.
+// Syntaxe de -signal (kind:argument) :
+//   registry                       valeur de registre -regkey (défaut)
+//   file:c:\kheops\done.flag       fichier présent
+//   mtime:c:\kheops\base.db        fichier modifié aujourd'hui
+//   content:c:\kheops\status.txt   contenu du fichier
+//   env:KHEOPS_DATESAUV            variable d'environnement
+//   http:http://localhost:8080/ok  statut HTTP 2xx
+//   socket:/run/kheops.sock        message reçu sur socket Unix (ou \\.\pipe\nom sous Windows)
+// Les valeurs (registre, contenu, variable, message) sont comparées avec la
+// règle -match : date du jour par défaut, message non vide pour socket.
+
+const signalRegistry = "registry"
+const signalFile = "file"
+const signalMtime = "mtime"
+const signalContent = "content"
+const signalEnv = "env"
+const signalHTTP = "http"
+const signalSocket = "socket"
+const signaldefval = signalRegistry
+const dateLayout = "02/01/2006"
+const socketReadTimeout = 10 // seconds for a socket client to send its message
+const httpTimeout = 5        // seconds
+
+type (
+	// readySignal : something telling the database is ready to be saved
+	readySignal interface {
+		Ready() (bool, error)
+		String() string
+	}
+
+	// registrySignal : registry value matches rule
+	registrySignal struct {
+		path string
+		rule *matchRule
+	}
+
+	// fileSignal : file exists
+	fileSignal struct {
+		path string
+	}
+
+	// mtimeSignal : file modified today
+	mtimeSignal struct {
+		path string
+	}
+
+	// contentSignal : file content matches rule
+	contentSignal struct {
+		path string
+		rule *matchRule
+	}
+
+	// envSignal : environment variable matches rule
+	envSignal struct {
+		name string
+		rule *matchRule
+	}
+
+	// httpSignal : endpoint answers with a 2xx status
+	httpSignal struct {
+		url    string
+		client *http.Client
+	}
+
+	// signalListener : Unix socket or named pipe server
+	signalListener interface {
+		Accept() (io.ReadCloser, error)
+		Close() error
+	}
+
+	// unixListener : signalListener on a Unix socket
+	unixListener struct {
+		listener net.Listener
+	}
+
+	// socketSignal : a message matching rule was received on a Unix socket or a named pipe
+	socketSignal struct {
+		path     string
+		rule     *matchRule
+		mu       sync.Mutex
+		received bool
+		message  string
+		err      error
+		started  bool
+		events   chan struct{}
+	}
+)
+
+// Build ready signal from -signal spec, values compared with -match rule
+func newReadySignal(spec string, regkey string, match string) (readySignal, error) {
+	kind, arg := spec, ""
+	if idx := strings.Index(spec, ":"); idx >= 0 {
+		kind, arg = spec[:idx], spec[idx+1:]
+	}
+	if kind != signalRegistry && arg == "" {
+		return nil, fmt.Errorf("Signal [%s] needs an argument (%s:...)", spec, kind)
+	}
+	defrule := matchDate
+	if kind == signalSocket {
+		defrule = matchAny
+	}
+	rule, err := newMatchRule(match, defrule)
+	if err != nil {
+		return nil, err
+	}
+	switch kind {
+	case signalRegistry:
+		if arg == "" {
+			arg = regkey
+		}
+		return &registrySignal{path: arg, rule: rule}, nil
+	case signalFile:
+		return &fileSignal{path: arg}, nil
+	case signalMtime:
+		return &mtimeSignal{path: arg}, nil
+	case signalContent:
+		return &contentSignal{path: arg, rule: rule}, nil
+	case signalEnv:
+		return &envSignal{name: arg, rule: rule}, nil
+	case signalHTTP:
+		return &httpSignal{url: arg, client: &http.Client{Timeout: httpTimeout * time.Second}}, nil
+	case signalSocket:
+		return &socketSignal{path: arg, rule: rule, events: make(chan struct{}, 1)}, nil
+	}
+	return nil, fmt.Errorf("Unknown signal kind [%s] (%s|%s|%s|%s|%s|%s|%s)", kind,
+		signalRegistry, signalFile, signalMtime, signalContent, signalEnv, signalHTTP, signalSocket)
+}
+
+// Ready : registry value (see readRegistryValue, windows only)
+func (s *registrySignal) Ready() (bool, error) {
+	value, found, err := readRegistryValue(s.path)
+	if err != nil {
+		return false, err
+	}
+	return s.rule.match(value, found), nil
+}
+
+func (s *registrySignal) String() string {
+	return fmt.Sprintf("%s:%s (%s)", signalRegistry, s.path, s.rule)
+}
+
+// Ready : file exists
+func (s *fileSignal) Ready() (bool, error) {
+	here, _, err := exists(s.path)
+	return here, err
+}
+
+func (s *fileSignal) String() string { return fmt.Sprintf("%s:%s", signalFile, s.path) }
+
+// Ready : file modified today
+func (s *mtimeSignal) Ready() (bool, error) {
+	here, modtime, err := exists(s.path)
+	if err != nil || !here {
+		return false, err
+	}
+	return modtime.Local().Format(dateLayout) == time.Now().Local().Format(dateLayout), nil
+}
+
+func (s *mtimeSignal) String() string { return fmt.Sprintf("%s:%s", signalMtime, s.path) }
+
+// Ready : file content matches rule
+func (s *contentSignal) Ready() (bool, error) {
+	content, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return s.rule.match("", false), nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return s.rule.match(string(content), true), nil
+}
+
+func (s *contentSignal) String() string {
+	return fmt.Sprintf("%s:%s (%s)", signalContent, s.path, s.rule)
+}
+
+// Ready : environment variable matches rule
+func (s *envSignal) Ready() (bool, error) {
+	value, found := os.LookupEnv(s.name)
+	return s.rule.match(value, found), nil
+}
+
+func (s *envSignal) String() string {
+	return fmt.Sprintf("%s:%s (%s)", signalEnv, s.name, s.rule)
+}
+
+// Ready : HTTP endpoint answers 2xx. Unreachable endpoint is "not ready", not an error.
+func (s *httpSignal) Ready() (bool, error) {
+	resp, err := s.client.Get(s.url)
+	if err != nil {
+		return false, nil
+	}
+	resp.Body.Close()
+	return resp.StatusCode >= 200 && resp.StatusCode < 300, nil
+}
+
+func (s *httpSignal) String() string { return fmt.Sprintf("%s:%s", signalHTTP, s.url) }
+
+// Ready : listen at first call, ready once a message was received
+func (s *socketSignal) Ready() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.started {
+		listener, err := listenSignal(s.path)
+		if err != nil {
+			return false, fmt.Errorf("Unable to listen on %s: %v", s.path, err)
+		}
+		s.started = true
+		go s.serve(listener)
+	}
+	if s.err != nil {
+		return false, s.err
+	}
+	return s.rule.match(s.message, s.received), nil
+}
+
+// Accept connections, one message line by connection
+func (s *socketSignal) serve(listener signalListener) {
+	defer listener.Close()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			s.mu.Lock()
+			s.err = err
+			s.mu.Unlock()
+			return
+		}
+		// un client muet ne bloque ni la boucle ni la source
+		go s.read(conn)
+	}
+}
+
+// Read one message line, at most socketReadTimeout seconds
+func (s *socketSignal) read(conn io.ReadCloser) {
+	defer conn.Close()
+	timeout := socketReadTimeout * time.Second
+	if withDeadline, ok := conn.(interface{ SetReadDeadline(time.Time) error }); !ok || withDeadline.SetReadDeadline(time.Now().Add(timeout)) != nil {
+		// pas d'échéance possible (tube nommé) : fermeture au bout du délai
+		timer := time.AfterFunc(timeout, func() { conn.Close() })
+		defer timer.Stop()
+	}
+	line, _ := bufio.NewReader(conn).ReadString('\n')
+	if strings.TrimSpace(line) == "" {
+		return
+	}
+	s.mu.Lock()
+	s.received = true
+	s.message = line
+	s.mu.Unlock()
+	notify(s.events)
+}
+
+func (s *socketSignal) String() string {
+	return fmt.Sprintf("%s:%s (%s)", signalSocket, s.path, s.rule)
+}
+
+// Listen on a Unix socket (AF_UNIX also exists on Windows 10)
+func listenUnix(path string) (signalListener, error) {
+	os.Remove(path)
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	return &unixListener{listener: listener}, nil
+}
+
+func (l *unixListener) Accept() (io.ReadCloser, error) {
+	return l.listener.Accept()
+}
+
+func (l *unixListener) Close() error {
+	return l.listener.Close()
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import "fmt"
+
+// Registry only exists on Windows
+func readRegistryValue(path string) (string, bool, error) {
+	return "", false, fmt.Errorf("Registry signal [%s] is only available on Windows, use -signal", path)
+}
+
+// Listen on a Unix socket
+func listenSignal(path string) (signalListener, error) {
+	return listenUnix(path)
+}
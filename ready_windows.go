@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/windows"
+	"golang.org/x/sys/windows/registry"
+)
+
+const pipePrefix = `\\.\pipe\`
+
+// pipeListener : signalListener on a Windows named pipe
+type pipeListener struct {
+	name string
+}
+
+// Registry root from its short or long name
+func registryRoot(name string) (registry.Key, error) {
+	switch strings.ToUpper(name) {
+	case "HKCU", "HKEY_CURRENT_USER":
+		return registry.CURRENT_USER, nil
+	case "HKLM", "HKEY_LOCAL_MACHINE":
+		return registry.LOCAL_MACHINE, nil
+	case "HKU", "HKEY_USERS":
+		return registry.USERS, nil
+	case "HKCR", "HKEY_CLASSES_ROOT":
+		return registry.CLASSES_ROOT, nil
+	}
+	return 0, fmt.Errorf("Bad Registry Root (HKCU|HKLM|HKU|HKCR) found [%s]", strings.ToUpper(name))
+}
+
+// Split registry path in root, key location and value name
+func splitRegistryPath(path string) (registry.Key, string, string, error) {
+	slices := strings.Split(path, "\\")
+	if len(slices) <= 2 {
+		return 0, "", "", fmt.Errorf("Bad Registry Path - Need (HKCU|HKLM|HKU|HKCR) then (Root) then (Key) [%s]", path)
+	}
+	regkey, err := registryRoot(slices[0])
+	if err != nil {
+		return 0, "", "", err
+	}
+	return regkey, strings.Join(slices[1:len(slices)-1], "\\"), slices[len(slices)-1], nil
+}
+
+// Read a registry value (HKCU|HKLM|HKU|HKCR\Path\To\Key\Value) as a string.
+// REG_SZ, REG_EXPAND_SZ (expanded), REG_DWORD and REG_QWORD (decimal) are supported.
+// found is false if key or value is missing.
+func readRegistryValue(path string) (value string, found bool, err error) {
+	regkey, location, name, err := splitRegistryPath(path)
+	if err != nil {
+		return "", false, err
+	}
+	keyvalue, err := registry.OpenKey(regkey, location, registry.QUERY_VALUE)
+	if err != nil {
+		return "", false, nil
+	}
+	defer keyvalue.Close()
+	_, valtype, err := keyvalue.GetValue(name, nil)
+	if err != nil {
+		return "", false, nil
+	}
+	switch valtype {
+	case registry.SZ:
+		s, _, err := keyvalue.GetStringValue(name)
+		return s, err == nil, nil
+	case registry.EXPAND_SZ:
+		s, _, err := keyvalue.GetStringValue(name)
+		if err != nil {
+			return "", false, nil
+		}
+		expanded, err := registry.ExpandString(s)
+		if err != nil {
+			return s, true, nil
+		}
+		return expanded, true, nil
+	case registry.DWORD, registry.QWORD:
+		n, _, err := keyvalue.GetIntegerValue(name)
+		return strconv.FormatUint(n, 10), err == nil, nil
+	}
+	return "", false, fmt.Errorf("Unsupported registry value type %d for [%s]", valtype, path)
+}
+
+// Watch : registry change notification on the key (RegNotifyChangeKeyValue).
+// Key must exist, otherwise the signal is polled.
+func (s *registrySignal) Watch(runctx context.Context) (<-chan struct{}, error) {
+	regkey, location, _, err := splitRegistryPath(s.path)
+	if err != nil {
+		return nil, err
+	}
+	key, err := registry.OpenKey(regkey, location, registry.NOTIFY)
+	if err != nil {
+		return nil, err
+	}
+	changed, err := windows.CreateEvent(nil, 0, 0, nil)
+	if err != nil {
+		key.Close()
+		return nil, err
+	}
+	cancel, err := windows.CreateEvent(nil, 1, 0, nil)
+	if err != nil {
+		windows.CloseHandle(changed)
+		key.Close()
+		return nil, err
+	}
+	// seule cette goroutine ferme cancel, une fois la surveillance terminée
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case <-runctx.Done():
+			windows.SetEvent(cancel)
+			<-stopped
+		case <-stopped:
+		}
+		windows.CloseHandle(cancel)
+	}()
+	events := make(chan struct{}, 1)
+	go func() {
+		// la notification est liée au thread qui l'a demandée
+		runtime.LockOSThread()
+		defer runtime.UnlockOSThread()
+		defer close(stopped)
+		defer key.Close()
+		defer windows.CloseHandle(changed)
+		for {
+			if err := windows.RegNotifyChangeKeyValue(windows.Handle(key), false, windows.REG_NOTIFY_CHANGE_LAST_SET, changed, true); err != nil {
+				mylog.WithError(err).Warnf("Registry notification on %s stopped", s.path)
+				return
+			}
+			fired, err := windows.WaitForMultipleObjects([]windows.Handle{changed, cancel}, false, windows.INFINITE)
+			if err != nil || fired != windows.WAIT_OBJECT_0 {
+				return
+			}
+			notify(events)
+		}
+	}()
+	return events, nil
+}
+
+// Listen on a named pipe (\\.\pipe\name) or a Unix socket
+func listenSignal(path string) (signalListener, error) {
+	if strings.HasPrefix(strings.ToLower(path), pipePrefix) {
+		return &pipeListener{name: path}, nil
+	}
+	return listenUnix(path)
+}
+
+// Accept : create a pipe instance and wait for a client
+func (l *pipeListener) Accept() (io.ReadCloser, error) {
+	name, err := windows.UTF16PtrFromString(l.name)
+	if err != nil {
+		return nil, err
+	}
+	handle, err := windows.CreateNamedPipe(name, windows.PIPE_ACCESS_INBOUND,
+		windows.PIPE_TYPE_BYTE|windows.PIPE_READMODE_BYTE|windows.PIPE_WAIT,
+		windows.PIPE_UNLIMITED_INSTANCES, 4096, 4096, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	if err := windows.ConnectNamedPipe(handle, nil); err != nil && err != windows.ERROR_PIPE_CONNECTED {
+		windows.CloseHandle(handle)
+		return nil, err
+	}
+	return os.NewFile(uintptr(handle), l.name), nil
+}
+
+// Close : nothing to release, instances are closed by the reader
+func (l *pipeListener) Close() error {
+	return nil
+}
@@ -0,0 +1,593 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// Mode démon "checknstart serve -jobs fichier" : chaque tâche est lancée
+// (checknstart -config ... -job nom ...) selon une expression cron, sur
+// modification d'un fichier ou à la demande (API de contrôle). Décalage
+// aléatoire (jitter), rattrapage ou abandon des exécutions manquées (arrêt,
+// veille), une seule exécution à la fois par tâche. Prévu pour systemd
+// (Type=notify, WatchdogSec), par exemple :
+//   [Service]
+//   Type=notify
+//   ExecStart=/usr/local/bin/checknstart serve -jobs /etc/checknstart/jobs.conf
+//   WatchdogSec=60
+//   Restart=on-failure
+//
+// Fichier des tâches : une section par tâche, "option = valeur" :
+//   [snapshot]
+//   schedule = */30 8-18 * * 1-5   # cron (5 ou 6 champs, @hourly, @every 2h)
+//   jitter = 120                   # secondes
+//   missed = run                   # run|skip
+//   trigger = watch:c:\b3s\dacq\base\darwinsav.db
+//   config = c:\b3s\checknstart.conf
+//   args = -snapshot
+//   timeout = 3600                 # secondes, 0 : sans limite
+// Une sauvegarde -snapshot protège le distant dans les mêmes versions (.0 à
+// .N) qu'une session : des sauvegardes fréquentes font tourner ces versions.
+
+const serveCommand = "serve"
+const serveStateName = "serve.json"
+const missedRun = "run"
+const missedSkip = "skip"
+const triggerWatch = "watch:"
+const reasonSchedule = "schedule"
+const reasonMissed = "missed"
+const reasonTrigger = "trigger"
+const reasonControl = "control"
+const servedebouncedefval = 30 // seconds without change before a watch trigger
+const servelatedefval = 60     // seconds late before a scheduled run is a missed one
+
+// Cron expressions: 5 fields, optional seconds, @descriptors
+var cronParser = cron.NewParser(cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor)
+
+type (
+	// serveJob : one scheduled job
+	serveJob struct {
+		Name     string        `json:"name"`
+		Spec     string        `json:"schedule,omitempty"`
+		Jitter   time.Duration `json:"-"`
+		Missed   string        `json:"missed"`
+		Triggers []string      `json:"triggers,omitempty"`
+		Config   string        `json:"config,omitempty"`
+		Args     []string      `json:"args,omitempty"`
+		Timeout  time.Duration `json:"-"`
+		schedule cron.Schedule
+		line     int
+		wake     chan string
+
+		mu      sync.Mutex
+		running bool
+		next    time.Time
+		last    jobRun
+		runs    int
+	}
+
+	// jobRun : last run of a job, kept in the state file
+	jobRun struct {
+		Start    time.Time `json:"start"`
+		End      time.Time `json:"end"`
+		Reason   string    `json:"reason"`
+		ExitCode int       `json:"exitCode"`
+	}
+
+	// jobStatus : GET /jobs
+	jobStatus struct {
+		*serveJob
+		Running bool      `json:"running"`
+		Next    time.Time `json:"next,omitempty"`
+		Last    *jobRun   `json:"last,omitempty"`
+		Runs    int       `json:"runs"`
+	}
+
+	// daemon : jobs, state file and running children
+	daemon struct {
+		jobs      []*serveJob
+		statepath string
+		exe       string
+		mu        sync.Mutex
+	}
+)
+
+// Read the jobs file
+func loadJobs(path string) ([]*serveJob, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var jobs []*serveJob
+	var job *serveJob
+	scanner := bufio.NewScanner(file)
+	for number := 1; scanner.Scan(); number++ {
+		line := strings.TrimSpace(scanner.Text())
+		if comment := strings.Index(line, " #"); comment >= 0 {
+			line = strings.TrimSpace(line[:comment])
+		}
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			job = &serveJob{Name: strings.TrimSpace(line[1 : len(line)-1]), Missed: missedRun, line: number, wake: make(chan string, 1)}
+			if job.Name == "" {
+				return nil, fmt.Errorf("%s:%d: empty job name", path, number)
+			}
+			for _, other := range jobs {
+				if other.Name == job.Name {
+					return nil, fmt.Errorf("%s:%d: job [%s] already defined line %d", path, number, job.Name, other.line)
+				}
+			}
+			jobs = append(jobs, job)
+			continue
+		}
+		if job == nil {
+			return nil, fmt.Errorf("%s:%d: option outside of a [job] section", path, number)
+		}
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("%s:%d: option = value expected", path, number)
+		}
+		if err := job.set(strings.TrimSpace(parts[0]), strings.Trim(strings.TrimSpace(parts[1]), "\"")); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", path, number, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(jobs) == 0 {
+		return nil, fmt.Errorf("%s: no job", path)
+	}
+	for _, job := range jobs {
+		if job.schedule == nil && len(job.Triggers) == 0 {
+			return nil, fmt.Errorf("%s:%d: job [%s] has neither schedule nor trigger", path, job.line, job.Name)
+		}
+	}
+	return jobs, nil
+}
+
+// Set one option of a job
+func (j *serveJob) set(name, value string) error {
+	var err error
+	switch name {
+	case "schedule":
+		if j.schedule, err = cronParser.Parse(value); err != nil {
+			return fmt.Errorf("Bad schedule [%s]: %v", value, err)
+		}
+		j.Spec = value
+	case "jitter", "timeout":
+		seconds, err := strconv.Atoi(value)
+		if err != nil || seconds < 0 {
+			return fmt.Errorf("Bad %s [%s] (seconds)", name, value)
+		}
+		if name == "jitter" {
+			j.Jitter = time.Duration(seconds) * time.Second
+		} else {
+			j.Timeout = time.Duration(seconds) * time.Second
+		}
+	case "missed":
+		if value != missedRun && value != missedSkip {
+			return fmt.Errorf("Bad missed [%s] (%s|%s)", value, missedRun, missedSkip)
+		}
+		j.Missed = value
+	case "trigger":
+		for _, trigger := range strings.Split(value, ",") {
+			trigger = strings.TrimSpace(trigger)
+			if !strings.HasPrefix(trigger, triggerWatch) || trigger == triggerWatch {
+				return fmt.Errorf("Bad trigger [%s] (%spath)", trigger, triggerWatch)
+			}
+			j.Triggers = append(j.Triggers, trigger)
+		}
+	case "config":
+		j.Config = value
+	case "args":
+		j.Args = splitArgs(value)
+	default:
+		return fmt.Errorf("unknown option [%s]", name)
+	}
+	return nil
+}
+
+// Command line of a run
+func (j *serveJob) command() []string {
+	args := []string{"-job", j.Name}
+	if j.Config != "" {
+		args = append(args, "-config", j.Config)
+	}
+	return append(args, j.Args...)
+}
+
+// Read last runs from the state file
+func (d *daemon) loadState() {
+	data, err := ioutil.ReadFile(d.statepath)
+	if err != nil {
+		return
+	}
+	state := make(map[string]jobRun)
+	if err := json.Unmarshal(data, &state); err != nil {
+		mylog.WithError(err).Warnf("State file %s unreadable, ignored", d.statepath)
+		return
+	}
+	for _, job := range d.jobs {
+		if run, ok := state[job.Name]; ok {
+			job.last = run
+		}
+	}
+}
+
+// Write last runs to the state file
+func (d *daemon) saveState() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	state := make(map[string]jobRun)
+	for _, job := range d.jobs {
+		job.mu.Lock()
+		if !job.last.Start.IsZero() {
+			state[job.Name] = job.last
+		}
+		job.mu.Unlock()
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		tmpname := d.statepath + ".tmp"
+		if err = ioutil.WriteFile(tmpname, data, 0644); err == nil {
+			err = os.Rename(tmpname, d.statepath)
+		}
+	}
+	if err != nil {
+		mylog.WithError(err).Errorf("Unable to write state file %s", d.statepath)
+	}
+}
+
+// Ask for a run; false if one is already pending
+func (j *serveJob) trigger(reason string) bool {
+	select {
+	case j.wake <- reason:
+		return true
+	default:
+		return false
+	}
+}
+
+// Run the job once. Runs of a job are serialized by its loop.
+func (d *daemon) run(runctx context.Context, job *serveJob, reason string) {
+	job.mu.Lock()
+	job.running = true
+	job.runs++
+	job.mu.Unlock()
+
+	run := jobRun{Start: time.Now(), Reason: reason, ExitCode: -1}
+	child := newSupervisor(d.exe, job.command()...)
+	mylog.Printf("[%s] start (%s): %s %s", job.Name, reason, d.exe, strings.Join(job.command(), " "))
+	if err := child.Start(); err != nil {
+		mylog.WithError(err).Errorf("[%s] unable to start", job.Name)
+	} else {
+		var timeout <-chan time.Time
+		if job.Timeout > 0 {
+			timer := time.NewTimer(job.Timeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		select {
+		case <-child.Done():
+		case <-runctx.Done():
+			d.stop(job, child, "shutdown")
+		case <-timeout:
+			d.stop(job, child, fmt.Sprintf("timeout %v", job.Timeout))
+		}
+		run.ExitCode = child.ExitCode()
+	}
+	run.End = time.Now()
+	switch run.ExitCode {
+	case 0:
+		mylog.Printf("[%s] done in %s", job.Name, run.End.Sub(run.Start).Round(time.Second))
+	case 9:
+		mylog.Printf("[%s] job locked by another run, nothing done", job.Name)
+	default:
+		mylog.Warnf("[%s] failed, exit code %d after %s", job.Name, run.ExitCode, run.End.Sub(run.Start).Round(time.Second))
+	}
+	job.mu.Lock()
+	job.running = false
+	job.last = run
+	job.mu.Unlock()
+	d.saveState()
+}
+
+// Stop a child: interrupt, killed after stopGrace
+func (d *daemon) stop(job *serveJob, child *supervisor, why string) {
+	mylog.Printf("[%s] stopping (%s)", job.Name, why)
+	stopctx, cancel := context.WithTimeout(context.Background(), stopGrace*time.Second)
+	defer cancel()
+	if err := child.Stop(stopctx); err != nil {
+		mylog.WithError(err).Errorf("[%s] stop error", job.Name)
+	}
+}
+
+// Random delay up to jitter
+func jitterDelay(jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(jitter)))
+}
+
+// Scheduling loop of one job
+func (d *daemon) loop(runctx context.Context, job *serveJob) {
+	now := time.Now()
+	var next time.Time
+	if job.schedule != nil {
+		next = job.schedule.Next(now)
+		// exécution manquée pendant l'arrêt du démon
+		job.mu.Lock()
+		last := job.last.Start
+		job.mu.Unlock()
+		if !last.IsZero() {
+			if due := job.schedule.Next(last); due.Before(now) {
+				if job.Missed == missedRun {
+					mylog.Printf("[%s] run of %s missed, run now", job.Name, due.Format(time.RFC3339))
+					job.trigger(reasonMissed)
+				} else {
+					mylog.Printf("[%s] run of %s missed, skipped", job.Name, due.Format(time.RFC3339))
+				}
+			}
+		}
+	}
+	for {
+		var timer *time.Timer
+		var fire <-chan time.Time
+		var at time.Time
+		if !next.IsZero() {
+			at = next.Add(jitterDelay(job.Jitter))
+			timer = time.NewTimer(time.Until(at))
+			fire = timer.C
+		}
+		job.mu.Lock()
+		job.next = at
+		job.mu.Unlock()
+		select {
+		case <-runctx.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			return
+		case reason := <-job.wake:
+			if timer != nil {
+				timer.Stop()
+			}
+			d.run(runctx, job, reason)
+			// créneau passé pendant l'exécution : pas de seconde exécution
+			if job.schedule != nil {
+				next = job.schedule.Next(time.Now())
+			}
+		case <-fire:
+			// réveil tardif (veille, horloge) : exécution manquée
+			late := time.Since(at)
+			if late > servelatedefval*time.Second && job.Missed == missedSkip {
+				mylog.Printf("[%s] run of %s missed (%s late), skipped", job.Name, next.Format(time.RFC3339), late.Round(time.Second))
+			} else {
+				d.run(runctx, job, reasonSchedule)
+			}
+			next = job.schedule.Next(time.Now())
+		}
+	}
+}
+
+// Watch triggers of a job: run once the file is quiet for debounce
+func (d *daemon) watch(runctx context.Context, job *serveJob, trigger string, debounce time.Duration) error {
+	path := strings.TrimPrefix(trigger, triggerWatch)
+	events, err := watchFile(runctx, path)
+	if err != nil {
+		return fmt.Errorf("[%s] unable to watch %s: %v", job.Name, path, err)
+	}
+	go func() {
+		var quiet <-chan time.Time
+		for {
+			select {
+			case <-runctx.Done():
+				return
+			case <-events:
+				quiet = time.After(debounce)
+			case <-quiet:
+				quiet = nil
+				mylog.Printf("[%s] %s changed", job.Name, path)
+				job.trigger(reasonTrigger)
+			}
+		}
+	}()
+	return nil
+}
+
+// Status of all jobs
+func (d *daemon) status() []jobStatus {
+	var list []jobStatus
+	for _, job := range d.jobs {
+		job.mu.Lock()
+		status := jobStatus{serveJob: job, Running: job.running, Next: job.next, Runs: job.runs}
+		if !job.last.Start.IsZero() {
+			last := job.last
+			status.Last = &last
+		}
+		job.mu.Unlock()
+		list = append(list, status)
+	}
+	return list
+}
+
+// Find a job by name
+func (d *daemon) job(name string) *serveJob {
+	for _, job := range d.jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// Control API of the daemon: GET /jobs, POST /jobs/<name>/run
+func (d *daemon) serveControl(runctx context.Context, address string) error {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/jobs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("GET only"))
+			return
+		}
+		writeJSON(w, http.StatusOK, d.status())
+	})
+	mux.HandleFunc("/jobs/", func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(r.URL.Path, "/jobs/")
+		if !strings.HasSuffix(name, "/run") {
+			writeError(w, http.StatusNotFound, fmt.Errorf("Unknown path %s", r.URL.Path))
+			return
+		}
+		if r.Method != http.MethodPost {
+			writeError(w, http.StatusMethodNotAllowed, errors.New("POST only"))
+			return
+		}
+		job := d.job(strings.TrimSuffix(name, "/run"))
+		if job == nil {
+			writeError(w, http.StatusNotFound, fmt.Errorf("Unknown job %s", strings.TrimSuffix(name, "/run")))
+			return
+		}
+		if !job.trigger(reasonControl) {
+			writeError(w, http.StatusConflict, errBusy)
+			return
+		}
+		writeJSON(w, http.StatusAccepted, map[string]string{"job": job.Name, "status": "queued"})
+	})
+	handler, err := controlHandler(address, mux)
+	if err != nil {
+		return err
+	}
+	listener, err := controlListener(address)
+	if err != nil {
+		return fmt.Errorf("Unable to listen for control on %s: %v", address, err)
+	}
+	server := &http.Server{Handler: handler, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			mylog.WithError(err).Error("Control listener error")
+		}
+	}()
+	go func() {
+		<-runctx.Done()
+		server.Close()
+	}()
+	mylog.Printf("Control API on %s", listener.Addr())
+	return nil
+}
+
+// Next runs, for the systemd status line
+func (d *daemon) summary() string {
+	var next []string
+	for _, status := range d.status() {
+		if !status.Next.IsZero() {
+			next = append(next, fmt.Sprintf("%s %s", status.Name, status.Next.Format("15:04")))
+		}
+	}
+	sort.Strings(next)
+	return fmt.Sprintf("%d job(s), next: %s", len(d.jobs), strings.Join(next, ", "))
+}
+
+// checknstart serve -jobs file [-state file] [-logdir dir] [-control address]
+func runServeCommand(args []string) int {
+	flags := flag.NewFlagSet(serveCommand, flag.ContinueOnError)
+	jobsfile := flags.String("jobs", "", "Jobs file, one [job] section per job")
+	statefile := flags.String("state", "", "Last runs state file [checknstart-serve.json in -logdir]")
+	logdir := flags.String("logdir", "", "Log directory of the daemon state [current directory]")
+	logformat := flags.String("logformat", logformatdefval, "Log format on stderr (text|json|logfmt)")
+	control := flags.String("control", "", "Control API listener (unix:/path, or 127.0.0.1:port with the bearer token of ~/"+controlTokenName+") [none]")
+	debounce := flags.Int("debounce", servedebouncedefval, "Seconds without change before a watch trigger runs a job")
+	if err := flags.Parse(args); err != nil {
+		return 1
+	}
+	if *jobsfile == "" || flags.NArg() != 0 {
+		fmt.Fprintf(os.Stderr, "usage: %s %s -jobs file [-state file] [-logdir dir] [-control address]\n", logFileName, serveCommand)
+		return 1
+	}
+	formatter, err := newLogFormatter(*logformat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	loghook.mu.Lock()
+	loghook.job = serveCommand
+	loghook.stage = serveCommand
+	loghook.mu.Unlock()
+	mylog.AddHook(loghook)
+	mylog.SetFormatter(formatter)
+	mylog.SetOutput(os.Stderr)
+
+	jobs, err := loadJobs(*jobsfile)
+	if err != nil {
+		mylog.Error(err)
+		return 1
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		mylog.Error(err)
+		return 1
+	}
+	d := &daemon{jobs: jobs, statepath: *statefile, exe: exe}
+	if d.statepath == "" {
+		dir := *logdir
+		if dir == "" {
+			dir = "."
+		}
+		d.statepath = filepath.Join(dir, fmt.Sprintf("%s-%s", logFileName, serveStateName))
+	}
+	d.loadState()
+
+	runctx, cancel := rootContext()
+	defer cancel()
+	for _, job := range jobs {
+		for _, trigger := range job.Triggers {
+			if err := d.watch(runctx, job, trigger, time.Duration(*debounce)*time.Second); err != nil {
+				mylog.Error(err)
+				return 1
+			}
+		}
+	}
+	if *control != "" {
+		if err := d.serveControl(runctx, *control); err != nil {
+			mylog.Error(err)
+			return 1
+		}
+	}
+	var loops sync.WaitGroup
+	for _, job := range jobs {
+		loops.Add(1)
+		go func(job *serveJob) {
+			defer loops.Done()
+			d.loop(runctx, job)
+		}(job)
+	}
+	mylog.Printf("ChecknStart %s serving %d job(s) from %s", VersionNum, len(jobs), *jobsfile)
+	stopWatchdog := startWatchdog(d.summary)
+	sdNotify("READY=1")
+
+	<-runctx.Done()
+	sdNotify("STOPPING=1")
+	mylog.Println("Stopping, waiting for running jobs.")
+	// les exécutions se font dans les boucles des tâches
+	loops.Wait()
+	stopWatchdog()
+	return 0
+}
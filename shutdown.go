@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// Annulation et arrêt propre.
+// Ctrl+C, SIGTERM, et sous Windows fermeture de console / fermeture de session /
+// arrêt (livrés par Go comme SIGTERM) annulent le contexte racine : les copies
+// en cours sont annulées puis défaites, la sauvegarde finale est faite si
+// demandée (-finalbackup), le programme externe est arrêté.
+
+const shutdownGrace = 120 // seconds given to the final backup and child stop
+
+// errCanceled : run interrupted by a termination signal
+var errCanceled = errors.New("Canceled by termination signal")
+
+// contextReader : reader failing as soon as its context is canceled
+type contextReader struct {
+	runctx context.Context
+	r      io.ReadCloser
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.runctx.Err(); err != nil {
+		return 0, errCanceled
+	}
+	return c.r.Read(p)
+}
+
+func (c *contextReader) Close() error {
+	return c.r.Close()
+}
+
+// Root context, canceled by Ctrl+C, SIGTERM or session logoff
+func rootContext() (context.Context, context.CancelFunc) {
+	runctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			mylog.Printf("Signal %v received, shutting down.", sig)
+			cancel()
+		case <-runctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return runctx, cancel
+}
+
+// Error due to cancellation?
+func isCanceled(ctx *contextCache, err error) bool {
+	return err == errCanceled || errors.Is(err, context.Canceled) || ctx.runctx.Err() != nil
+}
+
+// Graceful shutdown after cancellation: final backup if configured, then child stop
+func shutdown(ctx *contextCache, stage string) {
+	mylog.Printf("Shutdown during %s.", stage)
+	setStage(stageShutdown)
+	// les étapes suivantes ne doivent plus être annulées, mais limitées dans le temps
+	var cancel context.CancelFunc
+	ctx.runctx, cancel = context.WithTimeout(context.Background(), shutdownGrace*time.Second)
+	defer cancel()
+	if *ctx.finalbackup && !ctx.backupdone {
+		if err := doBackupNCopy(ctx); err != nil {
+			mylog.WithError(err).Error("Final backup error")
+		}
+	}
+	if ctx.child != nil {
+		if err := ctx.child.Stop(ctx.runctx); err != nil {
+			mylog.WithError(err).Error("Stop process error")
+		}
+	}
+}
+
+// Put back a protected local version after a failed copy (decompressed if needed)
+func rollbackLocal(ctx *contextCache, slot int) error {
+	if slot < 0 {
+		return nil
+	}
+	version := fmt.Sprintf("%s.%d", *ctx.localname, slot)
+	finfo, err := os.Stat(version)
+	if err != nil {
+		return err
+	}
+	os.Chmod(*ctx.localname, 0600)
+	if err := os.Remove(*ctx.localname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	in, codec, err := openStored(version)
+	if err != nil {
+		return err
+	}
+	if codec == compressNone {
+		in.Close()
+		return os.Rename(version, *ctx.localname)
+	}
+	out, err := os.Create(*ctx.localname)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	_, err = io.Copy(out, in)
+	in.Close()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chtimes(*ctx.localname, finfo.ModTime(), finfo.ModTime()); err != nil {
+		return err
+	}
+	return os.Remove(version)
+}
+
+// Put back the protected remote version after a failed copy
+func rollbackRemote(ctx *contextCache, slot int) error {
+	if slot < 0 {
+		return nil
+	}
+	remote := getRemotePath(ctx)
+	os.Chmod(remote, 0600)
+	if err := os.Remove(remote); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return os.Rename(fmt.Sprintf("%s.%d", remote, slot), remote)
+}
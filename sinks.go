@@ -0,0 +1,491 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Destinations supplémentaires des journaux (hooks logrus), en plus du fichier :
+// syslog RFC5424 (UDP/TCP), journald (protocole natif), expéditeur HTTP avec
+// tampon et reprises, journal d'événements Windows.
+// -logsink syslog://host:514,syslog+tcp://host:601,journald,http://collector/logs,eventlog
+
+const sinkSyslog = "syslog"
+const sinkSyslogUDP = "syslog+udp"
+const sinkSyslogTCP = "syslog+tcp"
+const sinkJournald = "journald"
+const sinkHTTP = "http"
+const sinkHTTPS = "https"
+const sinkEventlog = "eventlog"
+const sinkleveldefval = "warning"
+
+const syslogPort = "514"
+const syslogEnterprise = "checknstart@32473" // SD-ID, 32473 : numéro d'exemple (RFC5612)
+const journaldSocket = "/run/systemd/journal/socket"
+const sinkTimeout = 5       // seconds for a network write
+const httpBuffer = 1000     // entries kept while the collector is unreachable
+const httpBatch = 100       // entries sent at once
+const httpFlush = 2         // seconds between two sends
+const httpRetry = 3         // attempts for one batch
+const sinkCloseTimeout = 10 // seconds given to flush on exit
+const syslogBuffer = 1000   // entries waiting for the syslog collector
+
+type (
+	// logSink : logrus hook which must be closed (flush, connection)
+	logSink interface {
+		logrus.Hook
+		Close() error
+	}
+
+	// levelHook : fire only at or above a level
+	levelHook struct {
+		level logrus.Level
+	}
+
+	// syslogSink : RFC5424 over UDP (one datagram per message) or TCP (octet counting, RFC6587),
+	// sent by its own goroutine
+	syslogSink struct {
+		levelHook
+		network string
+		address string
+		host    string
+		conn    net.Conn
+		entries chan []byte
+		mu      sync.Mutex
+		dropped int
+		done    chan struct{}
+	}
+
+	// journaldSink : systemd journal native protocol over a unix datagram socket
+	journaldSink struct {
+		levelHook
+		mu   sync.Mutex
+		path string
+		conn net.Conn
+	}
+
+	// httpSink : JSON lines POSTed by batches, buffered and retried
+	httpSink struct {
+		levelHook
+		url       string
+		client    *http.Client
+		formatter logrus.Formatter
+		entries   chan []byte
+		mu        sync.Mutex
+		dropped   int
+		done      chan struct{}
+	}
+)
+
+// Log sinks in use
+var logsinks []logSink
+
+func (h levelHook) Levels() []logrus.Level {
+	var levels []logrus.Level
+	for _, level := range logrus.AllLevels {
+		if level <= h.level {
+			levels = append(levels, level)
+		}
+	}
+	return levels
+}
+
+// Sink error: never through mylog (it would loop)
+func sinkError(name string, err error) {
+	fmt.Fprintf(os.Stderr, "log sink %s error: %v\n", name, err)
+}
+
+// Create a sink from its spec
+func newLogSink(spec string, level logrus.Level) (logSink, error) {
+	switch spec {
+	case sinkJournald:
+		return newJournaldSink(journaldSocket, level)
+	case sinkEventlog:
+		return newEventlogSink(logFileName, level)
+	}
+	u, err := url.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Bad log sink [%s]: %v", spec, err)
+	}
+	switch u.Scheme {
+	case sinkSyslog, sinkSyslogUDP:
+		return newSyslogSink("udp", u.Host, level)
+	case sinkSyslogTCP:
+		return newSyslogSink("tcp", u.Host, level)
+	case sinkJournald:
+		// journald:/chemin/socket
+		return newJournaldSink(u.Path, level)
+	case sinkEventlog:
+		// eventlog:source
+		return newEventlogSink(u.Opaque, level)
+	case sinkHTTP, sinkHTTPS:
+		return newHTTPSink(spec, level), nil
+	}
+	return nil, fmt.Errorf("Unknown log sink [%s] (syslog://|syslog+tcp://|journald|http(s)://|eventlog)", spec)
+}
+
+// Add -logsink hooks to mylog
+func initSinks(ctx *contextCache) error {
+	if *ctx.logsink == "" {
+		return nil
+	}
+	level, err := logrus.ParseLevel(*ctx.sinklevel)
+	if err != nil {
+		return fmt.Errorf("Unknown log sink level [%s] (debug|info|warn|error)", *ctx.sinklevel)
+	}
+	for _, spec := range strings.Split(*ctx.logsink, ",") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+		sink, err := newLogSink(spec, level)
+		if err != nil {
+			return err
+		}
+		mylog.AddHook(sink)
+		logsinks = append(logsinks, sink)
+	}
+	return nil
+}
+
+// Flush and close sinks
+func closeSinks() {
+	// plus d'entrée vers des destinations fermées
+	hooks := make(logrus.LevelHooks)
+	hooks.Add(redactor)
+	hooks.Add(loghook)
+	mylog.ReplaceHooks(hooks)
+	for _, sink := range logsinks {
+		if err := sink.Close(); err != nil {
+			sinkError(fmt.Sprintf("%T", sink), err)
+		}
+	}
+	logsinks = nil
+}
+
+// Entry fields, sorted by name
+func sortedFields(entry *logrus.Entry) []string {
+	keys := make([]string, 0, len(entry.Data))
+	for key := range entry.Data {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Syslog severity for a logrus level
+func syslogSeverity(level logrus.Level) int {
+	switch level {
+	case logrus.PanicLevel:
+		return 0 // emerg
+	case logrus.FatalLevel:
+		return 2 // crit
+	case logrus.ErrorLevel:
+		return 3
+	case logrus.WarnLevel:
+		return 4
+	case logrus.InfoLevel:
+		return 6
+	}
+	return 7 // debug, trace
+}
+
+func newSyslogSink(network, address string, level logrus.Level) (*syslogSink, error) {
+	if address == "" {
+		return nil, fmt.Errorf("Syslog sink needs a host")
+	}
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		address = net.JoinHostPort(address, syslogPort)
+	}
+	host, _ := os.Hostname()
+	if host == "" {
+		host = "-"
+	}
+	s := &syslogSink{levelHook: levelHook{level}, network: network, address: address, host: host,
+		entries: make(chan []byte, syslogBuffer), done: make(chan struct{})}
+	go s.loop()
+	return s, nil
+}
+
+// Escape a SD-PARAM value (RFC5424 6.3.3)
+func sdEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`).Replace(value)
+}
+
+// RFC5424 message: <PRI>1 TIMESTAMP HOST APP PROCID MSGID [SD] MSG
+func formatSyslog(entry *logrus.Entry, host string) []byte {
+	var b bytes.Buffer
+	const facility = 1 // user-level
+	msgid := fmt.Sprint(entry.Data[fieldStage])
+	if _, ok := entry.Data[fieldStage]; !ok || msgid == "" {
+		msgid = "-"
+	}
+	fmt.Fprintf(&b, "<%d>1 %s %s %s %d %s ", facility*8+syslogSeverity(entry.Level),
+		entry.Time.Format(time.RFC3339Nano), host, logFileName, os.Getpid(), msgid)
+	if len(entry.Data) == 0 {
+		b.WriteString("-")
+	} else {
+		fmt.Fprintf(&b, "[%s", syslogEnterprise)
+		for _, key := range sortedFields(entry) {
+			fmt.Fprintf(&b, ` %s="%s"`, key, sdEscape(fmt.Sprint(entry.Data[key])))
+		}
+		b.WriteString("]")
+	}
+	b.WriteString(" ")
+	b.WriteString(strings.TrimRight(entry.Message, "\n"))
+	return b.Bytes()
+}
+
+// Queue the message, never block logging: drop it if the buffer is full
+func (s *syslogSink) Fire(entry *logrus.Entry) error {
+	select {
+	case s.entries <- formatSyslog(entry, s.host):
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Send messages until the channel is closed
+func (s *syslogSink) loop() {
+	defer close(s.done)
+	for msg := range s.entries {
+		s.mu.Lock()
+		dropped := s.dropped
+		s.dropped = 0
+		s.mu.Unlock()
+		if dropped > 0 {
+			notice := logrus.NewEntry(mylog)
+			notice.Level = logrus.WarnLevel
+			notice.Time = time.Now()
+			notice.Message = fmt.Sprintf("%d log entries dropped", dropped)
+			s.send(formatSyslog(notice, s.host))
+		}
+		s.send(msg)
+	}
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Write one message, reconnecting once on error (collector restarted)
+func (s *syslogSink) send(msg []byte) {
+	if s.network == "tcp" {
+		msg = append([]byte(fmt.Sprintf("%d ", len(msg))), msg...)
+	}
+	for attempt := 0; attempt < 2; attempt++ {
+		if s.conn == nil {
+			conn, err := net.DialTimeout(s.network, s.address, sinkTimeout*time.Second)
+			if err != nil {
+				sinkError(sinkSyslog, err)
+				return
+			}
+			s.conn = conn
+		}
+		s.conn.SetWriteDeadline(time.Now().Add(sinkTimeout * time.Second))
+		if _, err := s.conn.Write(msg); err == nil {
+			return
+		} else if attempt > 0 {
+			sinkError(sinkSyslog, err)
+		}
+		s.conn.Close()
+		s.conn = nil
+	}
+}
+
+// Flush queued messages, waiting at most sinkCloseTimeout
+func (s *syslogSink) Close() error {
+	close(s.entries)
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(sinkCloseTimeout * time.Second):
+		return fmt.Errorf("syslog %s: log entries not delivered", s.address)
+	}
+}
+
+func newJournaldSink(path string, level logrus.Level) (*journaldSink, error) {
+	if path == "" {
+		path = journaldSocket
+	}
+	conn, err := net.Dial("unixgram", path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to reach journald on %s: %v", path, err)
+	}
+	return &journaldSink{levelHook: levelHook{level}, path: path, conn: conn}, nil
+}
+
+// Journal field name: uppercase letters, digits and underscore, not starting with _
+func journalField(key string) string {
+	name := strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		}
+		return '_'
+	}, key)
+	return strings.TrimLeft(name, "_0123456789")
+}
+
+// Append one field, binary form if the value holds a newline
+func journalAppend(b *bytes.Buffer, key, value string) {
+	if key == "" {
+		return
+	}
+	if !strings.Contains(value, "\n") {
+		fmt.Fprintf(b, "%s=%s\n", key, value)
+		return
+	}
+	b.WriteString(key)
+	b.WriteByte('\n')
+	binary.Write(b, binary.LittleEndian, uint64(len(value)))
+	b.WriteString(value)
+	b.WriteByte('\n')
+}
+
+func (s *journaldSink) Fire(entry *logrus.Entry) error {
+	var b bytes.Buffer
+	journalAppend(&b, "MESSAGE", strings.TrimRight(entry.Message, "\n"))
+	journalAppend(&b, "PRIORITY", fmt.Sprintf("%d", syslogSeverity(entry.Level)))
+	journalAppend(&b, "SYSLOG_IDENTIFIER", logFileName)
+	for _, key := range sortedFields(entry) {
+		journalAppend(&b, journalField(key), fmt.Sprint(entry.Data[key]))
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.conn.Write(b.Bytes()); err != nil {
+		sinkError(sinkJournald, err)
+	}
+	return nil
+}
+
+func (s *journaldSink) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn.Close()
+}
+
+func newHTTPSink(address string, level logrus.Level) *httpSink {
+	s := &httpSink{
+		levelHook: levelHook{level},
+		url:       address,
+		client:    &http.Client{Timeout: sinkTimeout * time.Second},
+		formatter: &logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano},
+		entries:   make(chan []byte, httpBuffer),
+		done:      make(chan struct{}),
+	}
+	go s.loop()
+	return s
+}
+
+// Queue the entry, never block logging: drop it if the buffer is full
+func (s *httpSink) Fire(entry *logrus.Entry) error {
+	line, err := s.formatter.Format(entry)
+	if err != nil {
+		return err
+	}
+	select {
+	case s.entries <- line:
+	default:
+		s.mu.Lock()
+		s.dropped++
+		s.mu.Unlock()
+	}
+	return nil
+}
+
+// Send batches until the channel is closed
+func (s *httpSink) loop() {
+	defer close(s.done)
+	ticker := time.NewTicker(httpFlush * time.Second)
+	defer ticker.Stop()
+	var batch [][]byte
+	for {
+		select {
+		case line, ok := <-s.entries:
+			if !ok {
+				s.send(batch)
+				return
+			}
+			batch = append(batch, line)
+			if len(batch) < httpBatch {
+				continue
+			}
+		case <-ticker.C:
+		}
+		if len(batch) > 0 && s.send(batch) {
+			batch = nil
+		}
+		// collecteur injoignable : on garde au plus httpBuffer entrées
+		if len(batch) > httpBuffer {
+			s.mu.Lock()
+			s.dropped += len(batch) - httpBuffer
+			s.mu.Unlock()
+			batch = batch[len(batch)-httpBuffer:]
+		}
+	}
+}
+
+// POST a batch (JSON lines), with retries. True if delivered.
+func (s *httpSink) send(batch [][]byte) bool {
+	if len(batch) == 0 {
+		return true
+	}
+	body := bytes.Join(batch, nil)
+	s.mu.Lock()
+	if s.dropped > 0 {
+		body = append(body, []byte(fmt.Sprintf(`{"level":"warning","msg":"%d log entries dropped","time":"%s"}`+"\n",
+			s.dropped, time.Now().Format(time.RFC3339Nano)))...)
+		s.dropped = 0
+	}
+	s.mu.Unlock()
+	var err error
+	for attempt := 0; attempt < httpRetry; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+		var resp *http.Response
+		resp, err = s.client.Post(s.url, "application/x-ndjson", bytes.NewReader(body))
+		if err != nil {
+			continue
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 300 {
+			return true
+		}
+		err = fmt.Errorf("%s returns %s", s.url, resp.Status)
+		if resp.StatusCode < 500 {
+			// refusé par le collecteur : inutile de réessayer
+			sinkError(sinkHTTP, err)
+			return true
+		}
+	}
+	sinkError(sinkHTTP, err)
+	return false
+}
+
+// Flush buffered entries, waiting at most sinkCloseTimeout
+func (s *httpSink) Close() error {
+	close(s.entries)
+	select {
+	case <-s.done:
+		return nil
+	case <-time.After(sinkCloseTimeout * time.Second):
+		return fmt.Errorf("%s: log entries not delivered", s.url)
+	}
+}
@@ -0,0 +1,15 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Event log only exists on Windows
+func newEventlogSink(source string, level logrus.Level) (logSink, error) {
+	return nil, fmt.Errorf("Log sink %s is only available on Windows, use syslog or journald", sinkEventlog)
+}
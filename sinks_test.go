@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Entry as logged by mylog
+func sinkEntry(level logrus.Level, msg string, fields logrus.Fields) *logrus.Entry {
+	entry := logrus.NewEntry(logrus.New())
+	entry.Level = level
+	entry.Time = time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	entry.Message = msg
+	entry.Data = fields
+	return entry
+}
+
+func TestFormatSyslog(t *testing.T) {
+	entry := sinkEntry(logrus.ErrorLevel, "copy failed\n", logrus.Fields{fieldStage: "copy", "file": `c:\db "x"]`})
+	got := string(formatSyslog(entry, "host1"))
+	want := fmt.Sprintf(`<11>1 2024-03-01T12:30:00Z host1 %s %d copy [%s file="c:\\db \"x\"\]" stage="copy"] copy failed`,
+		logFileName, os.Getpid(), syslogEnterprise)
+	if got != want {
+		t.Errorf("formatSyslog =\n%s\nwant\n%s", got, want)
+	}
+
+	// sans champ : MSGID et SD vides
+	entry = sinkEntry(logrus.WarnLevel, "no stage", logrus.Fields{})
+	got = string(formatSyslog(entry, "host1"))
+	want = fmt.Sprintf("<12>1 2024-03-01T12:30:00Z host1 %s %d - - no stage", logFileName, os.Getpid())
+	if got != want {
+		t.Errorf("formatSyslog =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestSyslogSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	sink, err := newSyslogSink("udp", conn.LocalAddr().String(), logrus.WarnLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	entry := sinkEntry(logrus.ErrorLevel, "udp message", logrus.Fields{fieldStage: "wait"})
+	if err := sink.Fire(entry); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	buf := make([]byte, 4096)
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// un datagramme par message, sans préfixe de longueur
+	if got, want := string(buf[:n]), string(formatSyslog(entry, sink.host)); got != want {
+		t.Errorf("datagram =\n%s\nwant\n%s", got, want)
+	}
+}
+
+// Read one octet counted frame (RFC6587): "<length> <message>"
+func readFrame(r *bufio.Reader) (string, error) {
+	size, err := r.ReadString(' ')
+	if err != nil {
+		return "", err
+	}
+	length, err := strconv.Atoi(strings.TrimSuffix(size, " "))
+	if err != nil {
+		return "", fmt.Errorf("bad frame length %q", size)
+	}
+	msg := make([]byte, length)
+	_, err = io.ReadFull(r, msg)
+	return string(msg), err
+}
+
+func TestSyslogSinkTCP(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	sink, err := newSyslogSink("tcp", listener.Addr().String(), logrus.WarnLevel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	entries := []*logrus.Entry{
+		sinkEntry(logrus.ErrorLevel, "first", logrus.Fields{fieldStage: "copy"}),
+		sinkEntry(logrus.WarnLevel, "second\nline", logrus.Fields{}),
+	}
+	for _, entry := range entries {
+		if err := sink.Fire(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	for _, entry := range entries {
+		got, err := readFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := string(formatSyslog(entry, sink.host)); got != want {
+			t.Errorf("frame =\n%s\nwant\n%s", got, want)
+		}
+	}
+}
+
+func TestSyslogSinkNonBlocking(t *testing.T) {
+	// expéditeur bloqué sur le collecteur : personne ne vide la file
+	sink := &syslogSink{levelHook: levelHook{logrus.WarnLevel}, network: "tcp", address: "127.0.0.1:601", host: "host1",
+		entries: make(chan []byte, syslogBuffer), done: make(chan struct{})}
+	start := time.Now()
+	for i := 0; i < syslogBuffer+10; i++ {
+		if err := sink.Fire(sinkEntry(logrus.ErrorLevel, "collector down", logrus.Fields{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Fire ne fait que mettre en file, jamais d'attente du collecteur
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Fire blocked %s with the collector down", elapsed)
+	}
+	sink.mu.Lock()
+	dropped := sink.dropped
+	sink.mu.Unlock()
+	if dropped != 10 {
+		t.Errorf("%d entries dropped, want 10", dropped)
+	}
+}
+
+// Collector answering with the given status codes in turn (200 after the last one)
+type testCollector struct {
+	mu       sync.Mutex
+	statuses []int
+	requests []string
+}
+
+func (c *testCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.requests = append(c.requests, string(body))
+	status := http.StatusOK
+	if len(c.statuses) > 0 {
+		status, c.statuses = c.statuses[0], c.statuses[1:]
+	}
+	w.WriteHeader(status)
+}
+
+// Lines received by the collector, per request
+func (c *testCollector) lines() []int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var counts []int
+	for _, body := range c.requests {
+		counts = append(counts, strings.Count(body, "\n"))
+	}
+	return counts
+}
+
+func TestHTTPSinkBatch(t *testing.T) {
+	collector := &testCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	sink := newHTTPSink(server.URL, logrus.WarnLevel)
+
+	for i := 0; i < httpBatch+5; i++ {
+		if err := sink.Fire(sinkEntry(logrus.ErrorLevel, fmt.Sprintf("entry %d", i), logrus.Fields{})); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// un lot complet, puis le reste à la fermeture
+	counts := collector.lines()
+	if len(counts) != 2 || counts[0] != httpBatch || counts[1] != 5 {
+		t.Errorf("batches = %v, want [%d 5]", counts, httpBatch)
+	}
+	if !strings.Contains(collector.requests[0], `"msg":"entry 0"`) {
+		t.Errorf("first batch is not JSON lines: %.200s", collector.requests[0])
+	}
+}
+
+func TestHTTPSinkRetry(t *testing.T) {
+	collector := &testCollector{statuses: []int{http.StatusServiceUnavailable}}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	sink := newHTTPSink(server.URL, logrus.WarnLevel)
+
+	if err := sink.Fire(sinkEntry(logrus.ErrorLevel, "retried", logrus.Fields{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 503 : même lot envoyé de nouveau
+	if counts := collector.lines(); len(counts) != 2 || collector.requests[0] != collector.requests[1] {
+		t.Errorf("requests = %q, want the same batch twice", collector.requests)
+	}
+}
+
+func TestHTTPSinkRejected(t *testing.T) {
+	collector := &testCollector{statuses: []int{http.StatusBadRequest}}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	sink := newHTTPSink(server.URL, logrus.WarnLevel)
+
+	if err := sink.Fire(sinkEntry(logrus.ErrorLevel, "rejected", logrus.Fields{})); err != nil {
+		t.Fatal(err)
+	}
+	if err := sink.Close(); err != nil {
+		t.Fatal(err)
+	}
+	// 4xx : pas de nouvel essai
+	if counts := collector.lines(); len(counts) != 1 {
+		t.Errorf("%d requests, want 1", len(counts))
+	}
+}
+
+func TestSinkLevels(t *testing.T) {
+	level, err := logrus.ParseLevel(sinkleveldefval)
+	if err != nil {
+		t.Fatal(err)
+	}
+	levels := levelHook{level}.Levels()
+	for _, want := range []logrus.Level{logrus.ErrorLevel, logrus.WarnLevel} {
+		found := false
+		for _, l := range levels {
+			found = found || l == want
+		}
+		if !found {
+			t.Errorf("level %s not sent with the default -sinklevel", want)
+		}
+	}
+	for _, l := range levels {
+		if l == logrus.InfoLevel {
+			t.Errorf("info sent with the default -sinklevel")
+		}
+	}
+}
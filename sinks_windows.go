@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sys/windows/svc/eventlog"
+)
+
+const eventID = 1
+
+// eventlogSink : Windows Application event log
+type eventlogSink struct {
+	levelHook
+	log *eventlog.Log
+}
+
+// Open the event log source (registered through EventCreate when rights allow it)
+func newEventlogSink(source string, level logrus.Level) (logSink, error) {
+	if source == "" {
+		source = logFileName
+	}
+	// déjà enregistrée, ou pas de droits administrateur : les messages restent lisibles
+	eventlog.InstallAsEventCreate(source, eventlog.Error|eventlog.Warning|eventlog.Info)
+	log, err := eventlog.Open(source)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open event log %s: %v", source, err)
+	}
+	return &eventlogSink{levelHook: levelHook{level}, log: log}, nil
+}
+
+func (s *eventlogSink) Fire(entry *logrus.Entry) error {
+	msg := strings.TrimRight(entry.Message, "\n")
+	for _, key := range sortedFields(entry) {
+		msg += fmt.Sprintf("\r\n%s=%v", key, entry.Data[key])
+	}
+	var err error
+	switch {
+	case entry.Level <= logrus.ErrorLevel:
+		err = s.log.Error(eventID, msg)
+	case entry.Level == logrus.WarnLevel:
+		err = s.log.Warning(eventID, msg)
+	default:
+		err = s.log.Info(eventID, msg)
+	}
+	if err != nil {
+		sinkError(sinkEventlog, err)
+	}
+	return nil
+}
+
+func (s *eventlogSink) Close() error {
+	return s.log.Close()
+}
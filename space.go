@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Contrôle de l'espace libre avant d'écrire : copie vers le local, sauvegarde
+// dans le répertoire de travail, copie vers le distant. Le besoin compte le
+// nouveau fichier, la réécriture de la version protégée (compression,
+// chiffrement) et déduit la plus ancienne version si son emplacement est
+// réutilisé. -minfree garde une marge sur le volume.
+// Espace libre inconnu (transport, système) : message, pas de blocage.
+
+const minfreedefval = "64mb"
+
+// Bytes freed on the volume of path by its protection: oldest version deleted
+// if its slot is reused. Size of the in place rewrite if rewrite.
+func versionSpace(path string, rewrite bool) (freed uint64, rewritesize uint64) {
+	slot, reuse, err := pickVersionSlot(path, false)
+	if err == nil && reuse && slot >= 0 {
+		if finfo, err := os.Stat(fmt.Sprintf("%s.%d", path, slot)); err == nil {
+			freed = uint64(finfo.Size())
+		}
+	}
+	if rewrite {
+		if finfo, err := os.Stat(path); err == nil {
+			rewritesize = uint64(finfo.Size())
+		}
+	}
+	return freed, rewritesize
+}
+
+// Check that dir has need bytes free, plus -minfree
+func checkSpace(ctx *contextCache, dir string, lib string, need uint64) error {
+	margin, err := parseRate(*ctx.minfree)
+	if err != nil {
+		return fmt.Errorf("Bad free space margin [%s]: %v", *ctx.minfree, err)
+	}
+	free, err := diskFree(dir)
+	if err != nil {
+		mylog.Warnf("Free space of %s unknown (%v), %s not checked", dir, err, lib)
+		return nil
+	}
+	if free < need+margin {
+		return fmt.Errorf("Not enough space on %s for %s: %s free, %s needed (%s + %s margin)", dir, lib,
+			humanize.Bytes(free), humanize.Bytes(need+margin), humanize.Bytes(need), humanize.Bytes(margin))
+	}
+	if *ctx.verbose {
+		mylog.Printf("Free space on %s for %s: %s free, %s needed", dir, lib, humanize.Bytes(free), humanize.Bytes(need+margin))
+	}
+	return nil
+}
+
+// Need less what is freed, never below 0
+func spaceNeed(need, freed uint64) uint64 {
+	if freed >= need {
+		return 0
+	}
+	return need - freed
+}
+
+// Room for the remote file on the local volume
+func checkLocalSpace(ctx *contextCache) error {
+	freed, rewrite := versionSpace(*ctx.localname, *ctx.compress != compressNone || *ctx.encrypt)
+	need := spaceNeed(uint64(ctx.remoteinfo.Size())+rewrite, freed)
+	return checkSpace(ctx, filepath.Dir(*ctx.localname), "local copy", need)
+}
+
+// Room for the database backup in the work directory: about the local database size,
+// twice with -encrypt (backup rewritten in place through a temporary file)
+func checkTempSpace(ctx *contextCache) error {
+	var need uint64
+	if finfo, err := os.Stat(*ctx.localname); err == nil {
+		need = uint64(finfo.Size())
+		if *ctx.encrypt {
+			need += uint64(finfo.Size())
+		}
+	}
+	return checkSpace(ctx, getTempPath(ctx), "backup", need)
+}
+
+// Room for a size bytes file in place of the remote file
+func checkRemoteSpace(ctx *contextCache, size int64) error {
+	remote := getRemotePath(ctx)
+	freed, _ := versionSpace(remote, false)
+	return checkSpace(ctx, filepath.Dir(remote), "remote copy", spaceNeed(uint64(size), freed))
+}
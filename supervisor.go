@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// Superviseur du programme externe (DACQ.exe).
+// Seul propriétaire de exec.Cmd : les autres goroutines passent par ses
+// méthodes, protégées par un mutex, ou par le canal Done().
+
+const stateIdle = "idle"
+const stateRunning = "running"
+const stateStopping = "stopping"
+const stateExited = "exited"
+const stateFailed = "failed"
+const stopGrace = 10 // seconds before killing a child which does not stop
+
+type (
+	// stateEvent : child state change
+	stateEvent struct {
+		State    string
+		PID      int
+		ExitCode int
+		Err      error
+		At       time.Time
+	}
+
+	// supervisor : run and watch one child process, safe for concurrent use
+	supervisor struct {
+		mu          sync.Mutex
+		name        string
+		args        []string
+		cmd         *exec.Cmd
+		state       string
+		pid         int
+		exitcode    int
+		err         error
+		starts      int
+		done        chan struct{}
+		subscribers []chan stateEvent
+	}
+)
+
+// Create a supervisor. Done() is usable before Start().
+func newSupervisor(name string, args ...string) *supervisor {
+	return &supervisor{
+		name:     name,
+		args:     args,
+		state:    stateIdle,
+		exitcode: -1,
+		done:     make(chan struct{}),
+	}
+}
+
+// Subscribe to state events. Slow subscribers lose events, never block the supervisor.
+func (s *supervisor) Subscribe() <-chan stateEvent {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	events := make(chan stateEvent, 8)
+	s.subscribers = append(s.subscribers, events)
+	return events
+}
+
+// Change state and publish event. Lock must be held.
+func (s *supervisor) setState(state string) {
+	s.state = state
+	event := stateEvent{State: state, PID: s.pid, ExitCode: s.exitcode, Err: s.err, At: time.Now()}
+	for _, events := range s.subscribers {
+		select {
+		case events <- event:
+		default:
+		}
+	}
+}
+
+// Start the child. Done() is closed when it exits, or now if it can't start.
+func (s *supervisor) Start() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.state != stateIdle {
+		return fmt.Errorf("[%s] already started (%s)", s.name, s.state)
+	}
+	s.cmd = exec.Command(s.name, s.args...)
+	s.starts++
+	if err := s.cmd.Start(); err != nil {
+		s.err = err
+		s.setState(stateFailed)
+		close(s.done)
+		return err
+	}
+	s.pid = s.cmd.Process.Pid
+	s.setState(stateRunning)
+	go s.wait()
+	return nil
+}
+
+// Wait for child end, the only place where cmd.Wait is called
+func (s *supervisor) wait() {
+	err := s.cmd.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err != nil {
+		mylog.Printf("[%s] Wait returns: %v", s.name, err)
+	}
+	s.err = err
+	s.exitcode = s.cmd.ProcessState.ExitCode()
+	if err != nil && s.exitcode == -1 && s.state != stateStopping {
+		s.setState(stateFailed)
+	} else {
+		s.setState(stateExited)
+	}
+	close(s.done)
+}
+
+// Done : closed when the child is over
+func (s *supervisor) Done() <-chan struct{} {
+	return s.done
+}
+
+// ExitCode : child exit code, -1 while running (or killed)
+func (s *supervisor) ExitCode() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.exitcode
+}
+
+// PID : child process id, 0 if not started
+func (s *supervisor) PID() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pid
+}
+
+// State : current child state
+func (s *supervisor) State() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Starts : number of Start() calls
+func (s *supervisor) Starts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.starts
+}
+
+// Stop the child: interrupt, then kill if still there when runctx is over.
+// Interrupt does not exist on Windows, child is killed at once.
+func (s *supervisor) Stop(runctx context.Context) error {
+	s.mu.Lock()
+	switch s.state {
+	case stateRunning:
+	case stateStopping:
+		// arrêt déjà demandé par un autre appelant : attendre sa fin
+		s.mu.Unlock()
+		select {
+		case <-s.done:
+			return nil
+		case <-runctx.Done():
+			return fmt.Errorf("[%s] still running: %v", s.name, runctx.Err())
+		}
+	default:
+		s.mu.Unlock()
+		return nil
+	}
+	process := s.cmd.Process
+	s.setState(stateStopping)
+	s.mu.Unlock()
+
+	if err := process.Signal(os.Interrupt); err != nil {
+		return s.kill(process)
+	}
+	select {
+	case <-s.done:
+		return nil
+	case <-runctx.Done():
+	}
+	return s.kill(process)
+}
+
+// Kill the child and wait for its end. A child already gone is not an error.
+func (s *supervisor) kill(process *os.Process) error {
+	if err := process.Kill(); err != nil && !errors.Is(err, os.ErrProcessDone) {
+		return err
+	}
+	<-s.done
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"os"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Processus auxiliaire : le binaire de test relancé avec -test.run=TestHelperProcess.
+//   sleep n : attend n secondes
+//   exit n  : sort avec le code n
+
+const helperEnv = "CHECKNSTART_HELPER_PROCESS"
+
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv(helperEnv) != "1" {
+		return
+	}
+	args := os.Args
+	for len(args) > 0 && args[0] != "--" {
+		args = args[1:]
+	}
+	if len(args) != 3 {
+		os.Exit(2)
+	}
+	value, _ := strconv.Atoi(args[2])
+	switch args[1] {
+	case "sleep":
+		time.Sleep(time.Duration(value) * time.Second)
+		os.Exit(0)
+	case "exit":
+		os.Exit(value)
+	}
+	os.Exit(2)
+}
+
+// Supervisor of the helper process
+func helperSupervisor(t *testing.T, action string, value int) *supervisor {
+	t.Setenv(helperEnv, "1")
+	return newSupervisor(os.Args[0], "-test.run=TestHelperProcess", "--", action, strconv.Itoa(value))
+}
+
+// Read the supervisor from several goroutines until stop is closed
+func pollSupervisor(s *supervisor, stop <-chan struct{}, wg *sync.WaitGroup) {
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.State()
+				s.PID()
+				s.ExitCode()
+				s.Starts()
+				time.Sleep(time.Millisecond)
+			}
+		}()
+	}
+}
+
+func TestSupervisorExitCode(t *testing.T) {
+	s := helperSupervisor(t, "exit", 3)
+	events := s.Subscribe()
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	pollSupervisor(s, stop, &wg)
+
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.Done():
+	case <-time.After(30 * time.Second):
+		t.Fatal("child did not exit")
+	}
+	close(stop)
+	wg.Wait()
+
+	if code := s.ExitCode(); code != 3 {
+		t.Errorf("ExitCode = %d, want 3", code)
+	}
+	if state := s.State(); state != stateExited {
+		t.Errorf("State = %s, want %s", state, stateExited)
+	}
+	if first := <-events; first.State != stateRunning || first.PID == 0 {
+		t.Errorf("first event = %+v, want running with a pid", first)
+	}
+}
+
+func TestSupervisorConcurrentStartStop(t *testing.T) {
+	s := helperSupervisor(t, "sleep", 30)
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	pollSupervisor(s, stop, &wg)
+
+	// un seul Start doit réussir
+	var started sync.WaitGroup
+	var mu sync.Mutex
+	success := 0
+	for i := 0; i < 4; i++ {
+		started.Add(1)
+		go func() {
+			defer started.Done()
+			if s.Start() == nil {
+				mu.Lock()
+				success++
+				mu.Unlock()
+			}
+		}()
+	}
+	started.Wait()
+	if success != 1 {
+		t.Fatalf("%d successful Start, want 1", success)
+	}
+
+	// plusieurs Stop en parallèle, le processus est tué au bout du délai
+	var stopped sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		stopped.Add(1)
+		go func() {
+			defer stopped.Done()
+			runctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := s.Stop(runctx); err != nil {
+				t.Errorf("Stop: %v", err)
+			}
+		}()
+	}
+	stopped.Wait()
+	// chaque Stop attend la fin du programme, pas seulement le premier
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("child still running after Stop")
+	}
+	close(stop)
+	wg.Wait()
+
+	if state := s.State(); state != stateExited {
+		t.Errorf("State = %s, want %s", state, stateExited)
+	}
+	if starts := s.Starts(); starts != 1 {
+		t.Errorf("Starts = %d, want 1", starts)
+	}
+}
+
+func TestSupervisorStartFailure(t *testing.T) {
+	s := newSupervisor("checknstart-does-not-exist")
+	if err := s.Start(); err == nil {
+		t.Fatal("Start of a missing program succeeded")
+	}
+	select {
+	case <-s.Done():
+	default:
+		t.Fatal("Done not closed after a failed Start")
+	}
+	if state := s.State(); state != stateFailed {
+		t.Errorf("State = %s, want %s", state, stateFailed)
+	}
+	if err := s.Stop(context.Background()); err != nil {
+		t.Errorf("Stop of a failed child: %v", err)
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
+// Validation de la sauvegarde avant d'écraser la copie distante :
+// bornes de taille par rapport à la version précédente, puis contrôle
+// d'intégrité propre au fournisseur (ou commande -validcmd).
+
+const sizemindefval = 0.5
+const sizemaxdefval = 3.0
+const pgrestorecmddefval = "pg_restore"
+const mysqldumpcompleted = "-- Dump completed"
+
+// backupValidator : provider able to check its own backup file
+type backupValidator interface {
+	Validate(ctx *contextCache, file string) error
+}
+
+// Size of previous upload: current remote file, unless it is the empty database
+// put after retrieval. In that case, newest protected remote version.
+func previousVersionSize(ctx *contextCache) (int64, string, bool) {
+	remote := getRemotePath(ctx)
+	var emptysize int64 = -1
+	if *ctx.localempty != "" {
+		if finfo, err := os.Stat(*ctx.localempty); err == nil {
+			emptysize = finfo.Size()
+		}
+	}
+	if finfo, err := os.Stat(remote); err == nil && finfo.Size() != emptysize {
+		return finfo.Size(), remote, true
+	}
+	var newest os.FileInfo
+	var newestname string
+	for index := 0; index < maxversion; index++ {
+		name := fmt.Sprintf("%s.%d", remote, index)
+		finfo, err := os.Stat(name)
+		if err != nil || finfo.Size() == emptysize {
+			continue
+		}
+		if newest == nil || finfo.ModTime().After(newest.ModTime()) {
+			newest = finfo
+			newestname = name
+		}
+	}
+	if newest == nil {
+		return 0, "", false
+	}
+	return newest.Size(), newestname, true
+}
+
+// Check backup size versus previous version
+func checkBackupSize(ctx *contextCache, finfo os.FileInfo) error {
+	if finfo.Size() == 0 {
+		return fmt.Errorf("Backup file %s is empty", finfo.Name())
+	}
+	prevsize, prevname, found := previousVersionSize(ctx)
+	if !found || prevsize == 0 {
+		if *ctx.verbose {
+			mylog.Println("No previous version to check backup size against.")
+		}
+		return nil
+	}
+	ratio := float64(finfo.Size()) / float64(prevsize)
+	if *ctx.verbose {
+		mylog.Printf("Backup size %s versus previous %s (%s): ratio %.2f",
+			humanize.Bytes(uint64(finfo.Size())), humanize.Bytes(uint64(prevsize)), prevname, ratio)
+	}
+	if *ctx.sizemin > 0 && ratio < *ctx.sizemin {
+		return fmt.Errorf("Backup too small: %s versus %s for previous version (ratio %.2f < %.2f)",
+			humanize.Bytes(uint64(finfo.Size())), humanize.Bytes(uint64(prevsize)), ratio, *ctx.sizemin)
+	}
+	if *ctx.sizemax > 0 && ratio > *ctx.sizemax {
+		return fmt.Errorf("Backup too large: %s versus %s for previous version (ratio %.2f > %.2f)",
+			humanize.Bytes(uint64(finfo.Size())), humanize.Bytes(uint64(prevsize)), ratio, *ctx.sizemax)
+	}
+	return nil
+}
+
+// Run a validation command, valid if exit code is 0
+func runValidation(ctx *contextCache, tool string, args ...string) error {
+	cmd := exec.CommandContext(ctx.runctx, tool, args...)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		if *ctx.verbose {
+			mylog.Errorf("Validation exec error !\n%s", output)
+		}
+		return fmt.Errorf("Backup validation with %s failed: %v", tool, err)
+	}
+	return nil
+}
+
+// Validate : PRAGMA integrity_check must answer ok
+func (p sqliteProvider) Validate(ctx *contextCache, file string) error {
+	output, err := exec.CommandContext(ctx.runctx, p.Tool(ctx), file, "PRAGMA integrity_check;").CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("SQLite integrity check failed: %v %s", err, output)
+	}
+	if strings.TrimSpace(string(output)) != "ok" {
+		return fmt.Errorf("SQLite integrity check failed: %s", strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// Validate : pg_restore must be able to list the archive
+func (pgdumpProvider) Validate(ctx *contextCache, file string) error {
+	return runValidation(ctx, pgrestorecmddefval, "-l", file)
+}
+
+// Validate : a complete mysqldump ends with a "Dump completed" comment
+func (mysqldumpProvider) Validate(ctx *contextCache, file string) error {
+	in, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	var last string
+	scanner := bufio.NewScanner(in)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			last = line
+		}
+	}
+	if err := scanner.Err(); err != nil && err != io.EOF {
+		return err
+	}
+	if !strings.HasPrefix(last, mysqldumpcompleted) {
+		return fmt.Errorf("mysqldump output %s is incomplete (no \"%s\" trailer)", file, mysqldumpcompleted)
+	}
+	return nil
+}
+
+// Validate backup file before overwriting the remote copy.
+// -validcmd (like dbvalid) replaces provider check, {file} is replaced in -validarg.
+func validateBackup(ctx *contextCache, file string) error {
+	finfo, err := os.Stat(file)
+	if err != nil {
+		return err
+	}
+	if err := checkBackupSize(ctx, finfo); err != nil {
+		return err
+	}
+	if *ctx.validcmd != "" {
+		var args []string
+		for _, argument := range splitArgs(*ctx.validarg) {
+			if argument != "" {
+				args = append(args, strings.Replace(argument, "{file}", file, -1))
+			}
+		}
+		return runValidation(ctx, *ctx.validcmd, args...)
+	}
+	if validator, ok := ctx.provider.(backupValidator); ok {
+		return validator.Validate(ctx, file)
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// Attente sur événements plutôt que par scrutation : notifications système de
+// fichiers, notification de changement du registre, message reçu sur socket.
+// Les signaux sans notification (variable, HTTP) restent scrutés.
+
+const pollLoop = 1    // seconds between two checks, signal without notification
+const safetyLoop = 30 // seconds between two checks, signal with notification (missed events)
+
+// signalWatcher : signal able to notify a possible change
+type signalWatcher interface {
+	Watch(runctx context.Context) (<-chan struct{}, error)
+}
+
+// Notification channel for the ready signal, nil if it must be polled
+func watchSignal(runctx context.Context, ctx *contextCache) <-chan struct{} {
+	watcher, ok := ctx.signal.(signalWatcher)
+	if !ok {
+		return nil
+	}
+	events, err := watcher.Watch(runctx)
+	if err != nil {
+		if *ctx.verbose {
+			mylog.Warnf("No notification for %s (%v), polling every %d second(s)", ctx.signal, err, pollLoop)
+		}
+		return nil
+	}
+	return events
+}
+
+// Non blocking notification, one pending event is enough
+func notify(events chan struct{}) {
+	select {
+	case events <- struct{}{}:
+	default:
+	}
+}
+
+// Watch a file through its directory, so creation is seen too
+func watchFile(runctx context.Context, path string) (<-chan struct{}, error) {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, err
+	}
+	target := filepath.Clean(path)
+	events := make(chan struct{}, 1)
+	go func() {
+		defer watcher.Close()
+		for {
+			select {
+			case <-runctx.Done():
+				return
+			case event, ok := <-watcher.Events:
+				if !ok {
+					return
+				}
+				if strings.EqualFold(filepath.Clean(event.Name), target) {
+					notify(events)
+				}
+			case _, ok := <-watcher.Errors:
+				if !ok {
+					return
+				}
+				// on a perdu des événements : on force une vérification
+				notify(events)
+			}
+		}
+	}()
+	return events, nil
+}
+
+// Watch : file creation / removal
+func (s *fileSignal) Watch(runctx context.Context) (<-chan struct{}, error) {
+	return watchFile(runctx, s.path)
+}
+
+// Watch : file modification
+func (s *mtimeSignal) Watch(runctx context.Context) (<-chan struct{}, error) {
+	return watchFile(runctx, s.path)
+}
+
+// Watch : file content modification
+func (s *contentSignal) Watch(runctx context.Context) (<-chan struct{}, error) {
+	return watchFile(runctx, s.path)
+}
+
+// Watch : message received
+func (s *socketSignal) Watch(runctx context.Context) (<-chan struct{}, error) {
+	if _, err := s.Ready(); err != nil {
+		return nil, err
+	}
+	return s.events, nil
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+)
+
+// Répertoire de travail propre à chaque exécution (sauvegardes temporaires).
+// Supprimé en fin d'exécution, conservé en cas d'échec pour analyse.
+
+// Base directory for run workspaces: -workdir, or system temp directory (TEMP/TMP, TMPDIR, /tmp)
+func workdirBase(ctx *contextCache) string {
+	if *ctx.workdir != "" {
+		return *ctx.workdir
+	}
+	return os.TempDir()
+}
+
+// Create the workspace of this run
+func createWorkdir(ctx *contextCache, tag string) error {
+	base := workdirBase(ctx)
+	if err := os.MkdirAll(base, 0700); err != nil {
+		return fmt.Errorf("Unable to create work directory base %s: %v", base, err)
+	}
+	dir, err := ioutil.TempDir(base, fmt.Sprintf("%s-%s-", logFileName, tag))
+	if err != nil {
+		return fmt.Errorf("Unable to create work directory in %s: %v", base, err)
+	}
+	ctx.temp = dir
+	if *ctx.verbose {
+		mylog.Printf("Work directory is %s", dir)
+	}
+	return nil
+}
+
+// Remove the workspace, or keep it for forensics if the run failed
+func cleanWorkdir(ctx *contextCache, failed bool) {
+	if ctx.temp == "" {
+		return
+	}
+	if failed {
+		if err := encryptWorkdir(ctx, ctx.temp); err != nil {
+			mylog.WithError(err).Warnf("Work directory %s", ctx.temp)
+		}
+		mylog.Warnf("Run failed, work directory %s is kept", ctx.temp)
+		return
+	}
+	if err := os.RemoveAll(ctx.temp); err != nil {
+		mylog.WithError(err).Warnf("Unable to remove work directory %s", ctx.temp)
+		return
+	}
+	ctx.temp = ""
+}